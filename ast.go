@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"go/ast"
 	"go/types"
 )
@@ -26,7 +25,7 @@ func toIdentExprs(names []string) []ast.Expr {
 }
 
 // fun must be *ast.FuncDecl or *ast.FuncLit
-func defaultHandleStmt2(fun ast.Node, info *types.Info) ast.Stmt {
+func defaultHandleStmt2(fun ast.Node, info *types.Info) (ast.Stmt, error) {
 
 	var ft *ast.FuncType
 	switch v := fun.(type) {
@@ -43,20 +42,24 @@ func defaultHandleStmt2(fun ast.Node, info *types.Info) ast.Stmt {
 		ftrl = ft.Results.List
 	}
 	if len(ftrl) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	last := ftrl[len(ftrl)-1]
 	lastIdent, ok := last.Type.(*ast.Ident)
 	if !ok || lastIdent.Name != "error" {
-		return nil
+		return nil, nil
 	}
 
 	resultList := make([]ast.Expr, len(ft.Results.List))
 	for i, field := range ft.Results.List {
 		if i < len(resultList)-1 {
+			zero, err := zeroValueString(field.Type, info)
+			if err != nil {
+				return nil, err
+			}
 			resultList[i] = &ast.Ident{
-				Name: zeroValueString(field.Type, info),
+				Name: zero,
 			}
 		} else {
 			resultList[i] = &ast.Ident{
@@ -67,7 +70,7 @@ func defaultHandleStmt2(fun ast.Node, info *types.Info) ast.Stmt {
 
 	return &ast.ReturnStmt{
 		Results: resultList,
-	}
+	}, nil
 }
 
 func panicWithErrStmt(errVar string) *ast.ExprStmt {
@@ -140,35 +143,42 @@ func isDefined(t types.Type) bool {
 	}
 }
 
-func zeroValueString(typeExpr ast.Expr, info *types.Info) string {
+// zeroValueString returns the zero value of the type written as typeExpr.
+// The error is a *nodeError, since typeExpr is what can't be handled.
+func zeroValueString(typeExpr ast.Expr, info *types.Info) (string, error) {
 	t := info.TypeOf(typeExpr)
 	switch v := t.Underlying().(type) {
 	case *types.Basic:
 		switch v.Info() {
 		case types.IsBoolean:
-			return "false"
+			return "false", nil
 		case types.IsString:
-			return `""`
+			return `""`, nil
 		default:
-			return "0"
+			return "0", nil
 		}
-	case *types.Struct:
+	case *types.Struct, *types.Array:
 		if ident, ok := typeExpr.(*ast.Ident); ok {
-			return ident.Name + "{}"
+			return ident.Name + "{}", nil
 		}
 		if selector, ok := typeExpr.(*ast.SelectorExpr); ok {
-			pkg, ok := selector.X.(*ast.Ident)
-			if !ok {
-				panic("struct type ast.SelectorExpr.X should be Ident (package name)")
+			if pkg, ok := selector.X.(*ast.Ident); ok {
+				return pkg.Name + "." + selector.Sel.Name + "{}", nil
 			}
-			return pkg.Name + "." + selector.Sel.Name + "{}"
 		}
-		if _, ok := typeExpr.(*ast.StructType); ok {
-			return v.String() + "{}"
+		switch typeExpr.(type) {
+		case *ast.StructType:
+			return v.String() + "{}", nil
+		case *ast.ArrayType:
+			return types.ExprString(typeExpr) + "{}", nil
+		}
+		kind := "struct"
+		if _, ok := v.(*types.Array); ok {
+			kind = "array"
 		}
-		panic(errors.New("struct type's corresponding ast expr should only be Ident or SelectorExpr"))
+		return "", &nodeError{typeExpr, "can't write the zero value of " + kind + " result type " + types.ExprString(typeExpr)}
 	default:
-		return "nil"
+		return "nil", nil
 	}
 }
 
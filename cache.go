@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// The cache holds the transpiled files of packages, keyed by a hash of
+// everything they depend on, so that unchanged packages are skipped.
+// It lives in $GO2GENCACHE, which defaults to go2gen in the user cache
+// directory, and is disabled if that is "off".
+
+// cacheEntry is the JSON form of the transpiled files of a package.
+type cacheEntry struct {
+	Files []cachedFile `json:"files"`
+}
+
+type cachedFile struct {
+	Path   string     `json:"path"`
+	Data   []byte     `json:"data"`
+	Copied bool       `json:"copied,omitempty"`
+	Map    *sourceMap `json:"map,omitempty"` // relative to the directory of Path
+}
+
+// cacheDir returns the directory of the cache, or "" if it's disabled.
+func cacheDir() string {
+	dir := os.Getenv("GO2GENCACHE")
+	if dir == "off" {
+		return ""
+	}
+	if dir != "" {
+		return dir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go2gen")
+}
+
+var (
+	toolHashOnce sync.Once
+	toolHash     []byte
+)
+
+// toolVersion returns a hash of the go2gen executable, or nil if it can't
+// be read, since the output of any change to go2gen may differ.
+func toolVersion() []byte {
+	toolHashOnce.Do(func() {
+		exe, err := os.Executable()
+		if err != nil {
+			return
+		}
+		f, err := os.Open(exe)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err == nil {
+			toolHash = h.Sum(nil)
+		}
+	})
+	return toolHash
+}
+
+// cacheKey returns the key of the package p in the cache. It covers the
+// go2gen executable and the settings affecting its output, the source
+// files in the directory of p, the export data of the packages imported
+// by p and its external tests, and the keys of those transpiled along
+// with it, in deps. It returns "" if p can't be cached, such as when an
+// import can't be loaded.
+func cacheKey(p *go2Package, deps map[string]string) string {
+	if cacheDir() == "" || toolVersion() == nil {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "go2gen %x\n", toolVersion())
+
+	abs, err := filepath.Abs(p.dir)
+	if err != nil {
+		return ""
+	}
+	dst, err := outputDir(p.dir)
+	if err != nil {
+		return ""
+	}
+	dst, err = filepath.Abs(dst)
+	if err != nil {
+		return ""
+	}
+	ctxt := buildContext()
+	fmt.Fprintf(h, "dir %q\nout %q\nname %q\nline %v\nmap %v\ntags %q\ngoos %s\ngoarch %s\n",
+		abs, dst, *namePat, *lineDirectives, *sourceMaps, *buildTags, ctxt.GOOS, ctxt.GOARCH)
+
+	s, err := takeSnapshot(p.dir)
+	if err != nil {
+		return ""
+	}
+	var names []string
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !hashFile(h, "file "+name, filepath.Join(p.dir, name)) {
+			return ""
+		}
+	}
+
+	files := p.files()
+	if p.xtest != nil {
+		files = append(files, p.xtest.files()...)
+	}
+	for _, path := range importPaths(p.path, files) {
+		if key, ok := deps[path]; ok {
+			if key == "" {
+				return ""
+			}
+			fmt.Fprintf(h, "local %q %s\n", path, key)
+			continue
+		}
+		export := p.imports.exportFile(path)
+		if export == "" || !hashFile(h, "import "+path, export) {
+			return ""
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashFile writes a line starting with label, and the contents of the file
+// at path, to h. It reports whether the file could be read.
+func hashFile(h hash.Hash, label, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return false
+	}
+	fmt.Fprintf(h, "%s %x\n", label, sum.Sum(nil))
+	return true
+}
+
+func cachePath(key string) string {
+	return filepath.Join(cacheDir(), key[:2], key)
+}
+
+// cacheGet returns the files cached under key, if any.
+func cacheGet(key string) ([]outputFile, bool) {
+	b, err := ioutil.ReadFile(cachePath(key))
+	if err != nil {
+		return nil, false
+	}
+	var e cacheEntry
+	if json.Unmarshal(b, &e) != nil {
+		return nil, false
+	}
+	files := make([]outputFile, len(e.Files))
+	for i, cf := range e.Files {
+		files[i] = outputFile{path: cf.Path, data: cf.Data, copied: cf.Copied}
+		if cf.Map != nil {
+			pm, err := cf.Map.posMap(filepath.Dir(cf.Path))
+			if err != nil {
+				return nil, false
+			}
+			files[i].pos = pm
+		}
+	}
+	return files, true
+}
+
+// cachePut stores files under key. The cache is only an optimization,
+// so failing to write to it isn't an error.
+func cachePut(key string, files []outputFile) {
+	var e cacheEntry
+	for _, f := range files {
+		cf := cachedFile{Path: f.path, Data: f.data, Copied: f.copied}
+		if f.pos != nil {
+			sm, err := f.pos.sourceMap(filepath.Dir(f.path))
+			if err != nil {
+				return
+			}
+			cf.Map = sm
+		}
+		e.Files = append(e.Files, cf)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	path := cachePath(key)
+	if os.MkdirAll(filepath.Dir(path), 0777) != nil {
+		return
+	}
+	// write to a temporary file first, so that concurrent runs never
+	// read a partial entry
+	tmp, err := ioutil.TempFile(filepath.Dir(path), key+".tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func init() {
+	// keep the tests out of the user's cache; TestCache uses its own
+	os.Setenv("GO2GENCACHE", "off")
+}
+
+func TestCache(t *testing.T) {
+	cache, err := ioutil.TempDir("", "go2gen-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	os.Setenv("GO2GENCACHE", cache)
+	defer os.Setenv("GO2GENCACHE", "off")
+
+	dir := tempPkg(t, map[string]string{
+		"go.mod": "module example.com/m\n",
+		"a.go2":  "package a\n\nimport \"strconv\"\n\nfunc f(s string) (int, error) {\n\tn := check strconv.Atoi(s)\n\treturn n, nil\n}\n",
+	})
+	defer os.RemoveAll(dir)
+
+	run := func() []outputFile {
+		t.Helper()
+		r := transpileAll([]string{dir})[0]
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.files
+	}
+
+	first := run()
+	entries, _ := filepath.Glob(filepath.Join(cache, "*", "*"))
+	if len(entries) != 1 {
+		t.Fatalf("got cache entries %v, want one", entries)
+	}
+	second := run()
+	if len(second) != 1 || second[0].path != first[0].path || !bytes.Equal(second[0].data, first[0].data) {
+		t.Fatalf("cached files differ:\n%+v\nwant:\n%+v", second, first)
+	}
+	// offsets aren't kept, and aren't used
+	sm1, _ := first[0].pos.sourceMap(dir)
+	sm2, _ := second[0].pos.sourceMap(dir)
+	if !reflect.DeepEqual(sm1, sm2) {
+		t.Errorf("cached position map differs:\n%+v\nwant:\n%+v", sm2, sm1)
+	}
+
+	// the entry is used as long as the source is the same
+	b, err := ioutil.ReadFile(entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = bytes.Replace(b, []byte(`"data":"`), []byte(`"data":"Y2FjaGVk`), 1)
+	err = ioutil.WriteFile(entries[0], b, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := run(); !bytes.HasPrefix(files[0].data, []byte("cached")) {
+		t.Errorf("cache entry wasn't used:\n%s", files[0].data)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "a.go2"), []byte("package a\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := run(); string(files[0].data) != generatedComment+"\n\npackage a\n" {
+		t.Errorf("stale cache entry was used:\n%s", files[0].data)
+	}
+}
@@ -33,16 +33,10 @@ func (cs cuts) Len() int {
 func (cs cuts) Less(i, j int) bool {
 	a := cs[i]
 	b := cs[j]
-	if a.start > b.end {
-		return false
+	if a.start != b.start {
+		return a.start < b.start
 	}
-	if b.start > a.end {
-		return true
-	}
-	if a == b {
-		return false
-	}
-	panic("overlapping cuts")
+	return a.end < b.end
 }
 
 func (cs cuts) Swap(i, j int) {
@@ -56,6 +50,9 @@ func (cs cuts) Apply(s string) (string, error) {
 	var sb strings.Builder
 	i := 0
 	for _, c := range cs {
+		if c.start < i {
+			return "", &offsetError{c.start, "overlapping cuts"}
+		}
 		_, err := sb.WriteString(s[i:c.start])
 		if err != nil {
 			return "", err
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"os"
+	"sort"
+	"strings"
+)
+
+// diagnostic codes
+const (
+	codeParse           = "parse"
+	codeType            = "type"
+	codeImport          = "import"
+	codeUnresolvedCheck = "unresolved-check"
+	codeTransform       = "transform" // a check or handle go2gen can't transform
+	codeStale           = "stale"
+	codeExcluded        = "excluded" // a generated file whose .go2 file the build constraints leave out
+	codeConflict        = "conflict" // a file go2gen would overwrite, but didn't generate
+	codeInternal        = "internal" // a bug in go2gen
+	codeError           = "error"    // anything else, such as I/O errors
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// A diagnostic is a problem found in a package. Positions in .go2 files
+// refer to the .go2 source.
+type diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+func newDiagnostic(pos token.Position, code, msg string) diagnostic {
+	return diagnostic{
+		File:     pos.Filename,
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Severity: severityError,
+		Code:     code,
+		Message:  msg,
+	}
+}
+
+func (d diagnostic) String() string {
+	s := d.File
+	if d.Line > 0 {
+		s += fmt.Sprintf(":%d", d.Line)
+		if d.Column > 0 {
+			s += fmt.Sprintf(":%d", d.Column)
+		}
+	}
+	if d.Severity != severityError {
+		s += ": " + d.Severity
+	}
+	return s + ": " + d.Message
+}
+
+// diagnostics is an error made up of one or more diagnostics.
+type diagnostics []diagnostic
+
+func (ds diagnostics) Error() string {
+	lines := make([]string, len(ds))
+	for i, d := range ds {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sortDiagnostics(ds diagnostics) {
+	sort.SliceStable(ds, func(i, j int) bool {
+		a, b := ds[i], ds[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// offsetError is an error at a byte offset in a source file.
+type offsetError struct {
+	offset int
+	msg    string
+}
+
+func (e *offsetError) Error() string {
+	return e.msg
+}
+
+// nodeError is an error caused by an AST node.
+type nodeError struct {
+	node ast.Node
+	msg  string
+}
+
+func (e *nodeError) Error() string {
+	return e.msg
+}
+
+// internalError converts a recovered panic into a diagnostic at pos,
+// which is the position of the code being transformed, if known.
+func internalError(pos token.Position, r interface{}) diagnostics {
+	msg := fmt.Sprintf("internal error: %v; please report this as a bug", r)
+	return diagnostics{newDiagnostic(pos, codeInternal, msg)}
+}
+
+// parseDiagnostics converts an error returned by the parsers.
+func parseDiagnostics(err error) diagnostics {
+	list, ok := err.(scanner.ErrorList)
+	if !ok {
+		return diagnostics{{Severity: severityError, Code: codeParse, Message: err.Error()}}
+	}
+	var ds diagnostics
+	for _, e := range list {
+		ds = append(ds, newDiagnostic(e.Pos, codeParse, e.Msg))
+	}
+	return ds
+}
+
+// typeDiagnostic converts an error reported by go/types.
+func (p *go2Package) typeDiagnostic(err error) diagnostic {
+	te, ok := err.(types.Error)
+	if !ok {
+		return diagnostic{File: p.dir, Severity: severityError, Code: codeType, Message: err.Error()}
+	}
+	return newDiagnostic(p.position(te.Pos), codeType, te.Msg)
+}
+
+// position returns the position of pos, which refers to the .go2 source
+// in .go2 files, or the directory of p if pos is invalid.
+func (p *go2Package) position(pos token.Pos) token.Position {
+	if !pos.IsValid() {
+		return token.Position{Filename: p.dir}
+	}
+	return p.fset.Position(pos)
+}
+
+// report prints the diagnostics in err, which occurred
+// while handling the package in dir.
+func report(dir string, err error) {
+	ds, ok := err.(diagnostics)
+	if !ok {
+		ds = diagnostics{{File: dir, Severity: severityError, Code: codeError, Message: err.Error()}}
+	}
+	for _, d := range ds {
+		if *jsonOutput {
+			json.NewEncoder(os.Stdout).Encode(d)
+		} else {
+			fmt.Fprintln(os.Stderr, d)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePkgDiagnostics(t *testing.T) {
+	dir := tempPkg(t, map[string]string{
+		"a.go2": "package x\n\nfunc f() error {\n\tx := check f(,)\n}\n",
+		"b.go2": "package x\n\nfunc g() {\n\thandle err\n}\n",
+		"c.go":  "package y\n",
+		"d.go2": "package x\n",
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := parsePkg(dir)
+	diags, ok := err.(diagnostics)
+	if !ok {
+		t.Fatalf("got %v, want diagnostics", err)
+	}
+
+	want := []struct {
+		file         string
+		line, column int
+		code         string
+	}{
+		{"a.go2", 4, 15, codeParse},
+		{"b.go2", 4, 12, codeParse},
+		{"d.go2", 1, 9, codeParse}, // mismatched package
+	}
+	// only compare the first diagnostic of each file
+	var first diagnostics
+	for i, d := range diags {
+		if i == 0 || d.File != diags[i-1].File {
+			first = append(first, d)
+		}
+	}
+	if len(first) != len(want) {
+		t.Fatalf("got diagnostics for %d files, want %d:\n%v", len(first), len(want), diags)
+	}
+	for i, w := range want {
+		d := first[i]
+		if filepath.Base(d.File) != w.file || d.Line != w.line || d.Column != w.column || d.Code != w.code {
+			t.Errorf("got %v (%s), want %s:%d:%d (%s)", d, d.Code, w.file, w.line, w.column, w.code)
+		}
+	}
+}
+
+func TestUnresolvedChecks(t *testing.T) {
+	src := "package x\n\nfunc f() (int, error) { return 0, nil }\n\nfunc g() error {\n\tx := check f()\n\ty := check h(x)\n\t_ = y\n\tvar z string = 3\n\t_ = z\n\treturn nil\n}\n"
+
+	// the unrelated error on line 9 is listed after those of the checks
+	testTransformDiagnostics(t, src, []wantDiagnostic{
+		{7, 13, codeUnresolvedCheck, "unresolved check: can't determine the type of check h(x)"},
+		{7, 13, codeType, "undefined: h"},
+		{9, 17, codeType, "cannot use 3 (untyped int constant) as string value in variable declaration"},
+	})
+}
+
+func TestTypeErrors(t *testing.T) {
+	src := "package x\n\nfunc f() (int, error) { return 0, nil }\n\nvar s string = 1\n\nfunc g() error {\n\tx := check f()\n\t_ = x\n\treturn nil\n}\n"
+
+	// the checks are typed, but the package still has an error
+	testTransformDiagnostics(t, src, []wantDiagnostic{
+		{5, 16, codeType, "cannot use 1 (untyped int constant) as string value in variable declaration"},
+	})
+}
+
+func TestInvalidChecks(t *testing.T) {
+	src := `package x
+
+import "time"
+
+type S struct{}
+
+func f() (int, error) { return 0, nil }
+func e() error      { return nil }
+func n() int        { return 1 }
+func d() time.Duration { return 0 }
+
+func g() ((S), error) {
+	x := check f()
+	_ = x
+	return S{}, nil
+}
+
+func h() error {
+	y := 1 + check e()
+	check n()
+	check d()
+	_ = y
+	return nil
+}
+`
+	testTransformDiagnostics(t, src, []wantDiagnostic{
+		{12, 11, codeTransform, "can't write the zero value of struct result type (S)"},
+		{19, 17, codeTransform, "invalid check e(): only an error is checked, so there's no value to use in an expression"},
+		{20, 8, codeTransform, "invalid check n(): operand of type int isn't an error or a list of values ending in one"},
+		{21, 8, codeTransform, "invalid check d(): operand of type time.Duration isn't an error or a list of values ending in one"},
+	})
+}
+
+type wantDiagnostic struct {
+	line, column int
+	code         string
+	msg          string
+}
+
+// testTransformDiagnostics transforms a package made of src,
+// and compares the resulting diagnostics to want.
+func testTransformDiagnostics(t *testing.T, src string, want []wantDiagnostic) {
+	t.Helper()
+	dir := tempPkg(t, map[string]string{"a.go2": src})
+	defer os.RemoveAll(dir)
+
+	p, err := parsePkg(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transform(p)
+	diags, ok := err.(diagnostics)
+	if !ok {
+		t.Fatalf("got %v, want diagnostics", err)
+	}
+
+	if len(diags) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d:\n%v", len(diags), len(want), diags)
+	}
+	for i, w := range want {
+		d := diags[i]
+		if d.Line != w.line || d.Column != w.column || d.Code != w.code || d.Message != w.msg {
+			t.Errorf("got %v (%s), want %d:%d: %s (%s)", d, d.Code, w.line, w.column, w.msg, w.code)
+		}
+	}
+}
+
+// tempPkg writes files to a new temporary directory, and returns it.
+func tempPkg(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "go2gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(src), 0666)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestImportDiagnostics(t *testing.T) {
+	dir := tempPkg(t, map[string]string{
+		"go.mod": "module example.com/m\n",
+		"a.go2":  "package a\n\nimport (\n\t\"strconv\"\n\n\t\"example.com/m/missing\"\n)\n\nfunc f() error {\n\tx := check missing.F(check strconv.Atoi(\"1\"))\n\t_ = x\n\treturn nil\n}\n",
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := parsePkg(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transform(p)
+	diags, ok := err.(diagnostics)
+	if !ok || len(diags) != 1 {
+		t.Fatalf("got %v, want one diagnostic", err)
+	}
+	d := diags[0]
+	if d.Line != 6 || d.Column != 2 || d.Code != codeImport || !strings.HasPrefix(d.Message, `can't import "example.com/m/missing": `) {
+		t.Errorf("got %v (%s), want 6:2: can't import \"example.com/m/missing\": ... (%s)", d, d.Code, codeImport)
+	}
+}
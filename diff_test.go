@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/joelterry/fun"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	f := fun.Test(t, unifiedDiff)
+	f.In("a", "b", "x\ny\n", "x\ny\n").Out("")
+	f.In("a", "b", "x\ny\nz\n", "x\nY\nz\n").Out(
+		"--- a\n+++ b\n@@ -1,3 +1,3 @@\n x\n-y\n+Y\n z\n",
+	)
+	f.In("a", "b", "", "x\n").Out(
+		"--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n",
+	)
+	f.In("a", "b", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "1\n2\n3\n4\n5\n6\n7\n8\n9\nten\n").Out(
+		"--- a\n+++ b\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n",
+	)
+	f.In("a", "b", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n", "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n").Out(
+		"--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+	)
+	f.In("a", "b", "x\ny\n", "").Out(
+		"--- a\n+++ b\n@@ -1,2 +0,0 @@\n-x\n-y\n",
+	)
+	f.In("a", "b", "a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n").Out(
+		"--- a\n+++ b\n@@ -1,7 +1,6 @@\n-a\n-b\n c\n+b\n a\n b\n-b\n a\n+c\n",
+	)
+}
+
+func TestEditScriptLarge(t *testing.T) {
+	// a file being removed, as for an orphan, is edited directly, and
+	// the trace of a file changed throughout only keeps the live diagonals
+	var a, b []string
+	for i := 0; i < 8000; i++ {
+		a = append(a, fmt.Sprintf("line %d", i))
+	}
+	if edits := editScript(a, nil); len(edits) != len(a) {
+		t.Errorf("got %d edits removing %d lines", len(edits), len(a))
+	}
+	a = a[:2000]
+	for i := 0; i < len(a); i += 2 {
+		b = append(b, a[i])
+	}
+	edits := editScript(a, b)
+	removed := 0
+	for _, e := range edits {
+		if e.op == '-' {
+			removed++
+		}
+	}
+	if removed != len(a)-len(b) || len(edits) != len(a) {
+		t.Errorf("got %d edits removing %d lines, want %d removing %d", len(edits), removed, len(a), len(a)-len(b))
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// The files generated from .go2 files are named after the -name pattern,
+// in which %s stands for the name of the .go2 file without its extension.
+// The suffixes that the go command takes build constraints from, _test
+// and _GOOS_GOARCH, are kept at the end of the generated name, so that
+// with %s_go2.go, foo_linux_test.go2 produces foo_go2_linux_test.go.
+
+// checkNamePattern reports whether pattern can name generated files.
+func checkNamePattern(pattern string) error {
+	switch {
+	case strings.Count(pattern, "%s") != 1 || strings.Count(pattern, "%") != 1:
+		return errors.New("-name must contain %s once, and no other verb")
+	case !strings.HasSuffix(pattern, ".go"):
+		return errors.New("-name must end in .go")
+	case strings.ContainsAny(pattern, `/\`):
+		return errors.New("-name can't contain a directory")
+	}
+	if _, suffix := splitConstraints(strings.TrimSuffix(strings.Replace(pattern, "%s", "x", 1), ".go")); suffix != "" {
+		return errors.New("-name can't end in a _test, _GOOS or _GOARCH suffix")
+	}
+	return nil
+}
+
+// goFileName returns the name of the file generated from the .go2 file
+// name, given without its extension.
+func goFileName(name string) string {
+	stem, suffix := splitConstraints(name)
+	before, after := namePattern()
+	return before + stem + after + suffix + ".go"
+}
+
+// go2FileName returns the name, without extension, of the .go2 file that
+// the generated file name would be generated from, if any.
+func go2FileName(name string) (string, bool) {
+	if !strings.HasSuffix(name, ".go") {
+		return "", false
+	}
+	stem, suffix := splitConstraints(strings.TrimSuffix(name, ".go"))
+	before, after := namePattern()
+	if !strings.HasPrefix(stem, before) || !strings.HasSuffix(stem, after) || len(stem) < len(before)+len(after) {
+		return "", false
+	}
+	return stem[len(before):len(stem)-len(after)] + suffix, true
+}
+
+// namePattern returns what the -name pattern puts
+// before and after the name, other than .go.
+func namePattern() (before, after string) {
+	i := strings.Index(*namePat, "%s")
+	return (*namePat)[:i], strings.TrimSuffix((*namePat)[i+len("%s"):], ".go")
+}
+
+// splitConstraints splits name, a file name without extension, before the
+// suffixes that the go command takes build constraints from, as go/build
+// does: _test, preceded by _GOOS, _GOARCH or _GOOS_GOARCH. The part before
+// the first underscore is never a suffix.
+func splitConstraints(name string) (stem, suffix string) {
+	first := strings.Index(name, "_")
+	if first < 0 {
+		return name, ""
+	}
+	l := strings.Split(name[first:], "_")
+	end := len(l)
+	if l[end-1] == "test" {
+		end--
+	}
+	switch {
+	case end >= 3 && knownOS[l[end-2]] && knownArch[l[end-1]]:
+		end -= 2
+	case end >= 2 && (knownOS[l[end-1]] || knownArch[l[end-1]]):
+		end--
+	}
+	n := first + len(strings.Join(l[:end], "_"))
+	return name[:n], name[n:]
+}
+
+// the lists of go/build
+var knownOS = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true,
+	"hurd": true, "illumos": true, "ios": true, "js": true, "linux": true, "nacl": true,
+	"netbsd": true, "openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+	"windows": true, "zos": true,
+}
+
+var knownArch = map[string]bool{
+	"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true, "arm64": true,
+	"arm64be": true, "loong64": true, "mips": true, "mipsle": true, "mips64": true,
+	"mips64le": true, "mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+	"ppc64le": true, "riscv": true, "riscv64": true, "s390": true, "s390x": true,
+	"sparc": true, "sparc64": true, "wasm": true,
+}
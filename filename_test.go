@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/joelterry/fun"
+)
+
+func TestSplitConstraints(t *testing.T) {
+	f := fun.Test(t, splitConstraints)
+	f.In("foo").Out("foo", "")
+	f.In("foo_bar").Out("foo_bar", "")
+	f.In("foo_test").Out("foo", "_test")
+	f.In("foo_linux").Out("foo", "_linux")
+	f.In("foo_bar_linux_amd64_test").Out("foo_bar", "_linux_amd64_test")
+	f.In("foo_amd64_linux").Out("foo_amd64", "_linux")
+	f.In("linux_test").Out("linux", "_test")
+	f.In("_linux").Out("", "_linux")
+}
+
+func TestFileNames(t *testing.T) {
+	defer func(pat string) { *namePat = pat }(*namePat)
+
+	tests := []struct {
+		pattern, go2Name, goName string
+	}{
+		{"%s.go", "foo", "foo.go"},
+		{"%s.go", "foo_linux_test", "foo_linux_test.go"},
+		{"%s_go2.go", "foo", "foo_go2.go"},
+		{"%s_go2.go", "foo_test", "foo_go2_test.go"},
+		{"%s_go2.go", "foo_windows_386", "foo_go2_windows_386.go"},
+		{"gen_%s.go", "foo_test", "gen_foo_test.go"},
+	}
+	for _, tt := range tests {
+		*namePat = tt.pattern
+		if got := goFileName(tt.go2Name); got != tt.goName {
+			t.Errorf("%s: goFileName(%q) = %q, want %q", tt.pattern, tt.go2Name, got, tt.goName)
+		}
+		if got, ok := go2FileName(tt.goName); !ok || got != tt.go2Name {
+			t.Errorf("%s: go2FileName(%q) = %q, %v, want %q", tt.pattern, tt.goName, got, ok, tt.go2Name)
+		}
+	}
+
+	*namePat = "%s_go2.go"
+	for _, name := range []string{"foo.go", "foo_test.go", "foo_go2.txt"} {
+		if got, ok := go2FileName(name); ok {
+			t.Errorf("go2FileName(%q) = %q, want no .go2 file", name, got)
+		}
+	}
+}
+
+func TestCheckNamePattern(t *testing.T) {
+	for _, pattern := range []string{"%s.go", "%s_go2.go", "gen_%s.go"} {
+		if err := checkNamePattern(pattern); err != nil {
+			t.Errorf("%s: %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"foo.go", "%s%s.go", "%s_%d.go", "%s.txt", "gen/%s.go", "%s_test.go", "%s_linux.go"} {
+		if checkNamePattern(pattern) == nil {
+			t.Errorf("%s: got no error", pattern)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// goCommands are the go subcommands that go2gen can run
+// on transpiled packages without writing them to disk.
+var goCommands = map[string]bool{
+	"build": true,
+	"run":   true,
+	"test":  true,
+	"vet":   true,
+}
+
+// overlay is the JSON format read by the go command's -overlay flag.
+type overlay struct {
+	Replace map[string]string
+}
+
+// runGo transpiles the packages that args name, and those they import, in
+// memory, and then runs the go subcommand cmd with args, overlaying the
+// generated files onto the source tree. References to generated files in the output of the go
+// command are translated into references to their .go2 sources.
+// It returns the exit status of the go command.
+func runGo(cmd string, args []string) (int, error) {
+	if *outDir != "" {
+		return 0, fmt.Errorf("-o can't be used with go2gen %s", cmd)
+	}
+
+	ga, err := parseGoArgs(cmd, append(strings.Fields(os.Getenv("GOFLAGS")), args...))
+	if err != nil {
+		return 0, err
+	}
+	if ga.tagsSet {
+		if *buildTags != "" && *buildTags != ga.tags {
+			return 0, fmt.Errorf("-tags %q and go %s -tags %q select different files", *buildTags, cmd, ga.tags)
+		}
+		// the files are selected with the tags the go command builds with
+		*buildTags = ga.tags
+	}
+	dirs, err := goDirs(ga)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempDir("", "go2gen")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	t := newTranslator()
+	ov, err := writeOverlay(tmp, dirs, t)
+	if err != nil {
+		return 0, err
+	}
+
+	cmdArgs := []string{cmd, "-overlay=" + ov}
+	if *buildTags != "" && !ga.tagsSet {
+		// select the same files the packages were transpiled with
+		cmdArgs = append(cmdArgs, "-tags="+*buildTags)
+	}
+	cmdArgs = append(cmdArgs, args...)
+	c := exec.Command("go", cmdArgs...)
+	c.Stdin = os.Stdin
+	err = runTranslated(c, t, cmd != "run")
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// goArgs is what go2gen needs to know of the arguments of a go command.
+type goArgs struct {
+	// dirs are the directories of the packages and files given by path,
+	// and paths the packages given by import path. Both may be patterns
+	// ending in "...".
+	dirs  []string
+	paths []string
+
+	// tags is the value of -tags, if tagsSet.
+	tags    string
+	tagsSet bool
+}
+
+// goValueFlags are the flags of go build, run, test and vet that take a
+// value, which can be the next argument rather than follow an =.
+var goValueFlags = map[string]bool{
+	"asmflags": true, "buildmode": true, "compiler": true, "gccgoflags": true,
+	"gcflags": true, "installsuffix": true, "ldflags": true, "mod": true,
+	"modfile": true, "o": true, "overlay": true, "p": true, "pgo": true,
+	"pkgdir": true, "tags": true, "toolexec": true, "C": true, "exec": true,
+	"covermode": true, "coverpkg": true, "coverprofile": true, "vettool": true,
+
+	// go test, including the flags of the test binary
+	"bench": true, "benchtime": true, "blockprofile": true, "blockprofilerate": true,
+	"count": true, "cpu": true, "cpuprofile": true, "fuzz": true, "fuzzcachedir": true,
+	"fuzzminimizetime": true, "fuzztime": true, "list": true, "memprofile": true,
+	"memprofilerate": true, "mutexprofile": true, "mutexprofilefraction": true,
+	"outputdir": true, "parallel": true, "run": true, "shuffle": true, "skip": true,
+	"timeout": true, "trace": true, "vet": true,
+}
+
+// parseGoArgs finds the packages and the -tags in args, the arguments of
+// the go subcommand cmd. It rejects the flags that would keep the overlay
+// from matching the files that the go command reads.
+func parseGoArgs(cmd string, args []string) (goArgs, error) {
+	var ga goArgs
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-args" {
+			// the rest is for the test binary
+			break
+		}
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			name := strings.TrimLeft(arg, "-")
+			value := ""
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, value = name[:eq], name[eq+1:]
+			} else if goValueFlags[name] && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			switch name {
+			case "tags":
+				ga.tags, ga.tagsSet = value, true
+			case "C", "overlay":
+				return goArgs{}, fmt.Errorf("go2gen %s doesn't support -%s", cmd, name)
+			}
+			continue
+		}
+
+		// go run takes a package or .go files, followed
+		// by the arguments of the program
+		if cmd == "run" {
+			if !strings.HasSuffix(arg, ".go") {
+				ga.addDir(arg)
+				break
+			}
+			for ; i < len(args) && strings.HasSuffix(args[i], ".go"); i++ {
+				ga.addDir(filepath.Dir(args[i]))
+			}
+			break
+		}
+		ga.addDir(arg)
+	}
+	return ga, nil
+}
+
+// addDir adds the package path to ga.dirs, or to ga.paths
+// if it's an import path.
+func (ga *goArgs) addDir(path string) {
+	if path == "." || path == ".." || filepath.IsAbs(path) ||
+		strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") ||
+		strings.HasPrefix(path, "."+string(filepath.Separator)) || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		ga.dirs = append(ga.dirs, path)
+		return
+	}
+	ga.paths = append(ga.paths, path)
+}
+
+// goDirs returns the directories of the packages to transpile for a go
+// command run with ga: those it names, or the current directory if it
+// names none, and those of the packages under the current directory that
+// they import, directly or not. Packages given by import path are only
+// transpiled if they're under the current directory. Of these, only the
+// directories with .go2 or generated files are returned, so a broken
+// package elsewhere doesn't keep the command from running.
+func goDirs(ga goArgs) ([]string, error) {
+	all := func(string) (bool, error) { return true, nil }
+	local, err := expandDirs([]string{"./..."}, all)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]string) // import path -> dir
+	for _, dir := range local {
+		path, err := importPath(dir)
+		if err != nil {
+			return nil, err
+		}
+		if path != "" {
+			byPath[path] = dir
+		}
+	}
+
+	var roots []string
+	for _, dir := range ga.dirs {
+		// the go command reports the packages that can't be found
+		dirs, err := expandDirs([]string{dir}, all)
+		if err == nil {
+			roots = append(roots, dirs...)
+		}
+	}
+	for _, pattern := range ga.paths {
+		prefix := strings.TrimSuffix(pattern, "/"+recursiveSuffix)
+		for path, dir := range byPath {
+			if path == pattern || (prefix != pattern && (path == prefix || strings.HasPrefix(path, prefix+"/"))) {
+				roots = append(roots, dir)
+			}
+		}
+	}
+	if len(ga.dirs) == 0 && len(ga.paths) == 0 {
+		roots = []string{"."}
+	}
+
+	seen := make(map[string]bool)
+	var dirs []string
+	for len(roots) > 0 {
+		dir := filepath.Clean(roots[len(roots)-1])
+		roots = roots[:len(roots)-1]
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		ok, err := hasGo2OrGeneratedFiles(dir)
+		if err != nil {
+			continue
+		}
+		if ok {
+			dirs = append(dirs, dir)
+		}
+		imports, err := dirImports(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range imports {
+			if d, ok := byPath[path]; ok {
+				roots = append(roots, d)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// dirImports returns the paths imported by the .go and .go2 files in dir
+// that the build constraints select. Only the imports are parsed, and the
+// files that can't be are left for the package to report.
+func dirImports(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(0)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	ctxt := buildContext()
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range names {
+		if ext := filepath.Ext(name); ext != ".go" && ext != extension {
+			continue
+		}
+		if match, err := matchFile(ctxt, dir, name); err != nil || !match {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		files = append(files, f)
+	}
+	return importPaths("", files), nil
+}
+
+// runTranslated runs c, translating its standard error and, if stdout is
+// true, its standard output. The output of a program started by go run
+// is best left alone, since translating it line by line holds back prompts.
+func runTranslated(c *exec.Cmd, t *translator, stdout bool) error {
+	var pipes []io.Reader
+	stderr, err := c.StderrPipe()
+	if err != nil {
+		return err
+	}
+	pipes = append(pipes, stderr)
+	outputs := []io.Writer{os.Stderr}
+	if stdout {
+		r, err := c.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		pipes = append(pipes, r)
+		outputs = append(outputs, os.Stdout)
+	} else {
+		c.Stdout = os.Stdout
+	}
+
+	err = c.Start()
+	if err != nil {
+		return err
+	}
+	// all output has to be read before calling Wait
+	var wg sync.WaitGroup
+	for i, r := range pipes {
+		wg.Add(1)
+		go func(w io.Writer, r io.Reader) {
+			defer wg.Done()
+			t.copy(w, r)
+		}(outputs[i], r)
+	}
+	wg.Wait()
+	return c.Wait()
+}
+
+// writeOverlay transpiles the packages in dirs, writes the generated files
+// and an overlay file mapping them onto the source tree to tmp, and returns
+// the path of the overlay file. The generated files are registered with t
+// under both paths. Every package is attempted, and each failure is logged
+// before an error is returned.
+func writeOverlay(tmp string, dirs []string, t *translator) (string, error) {
+	ov := overlay{Replace: make(map[string]string)}
+	failed := 0
+
+	for _, tp := range transpileAll(dirs) {
+		if tp.err != nil {
+			report(tp.dir, tp.err)
+			failed++
+			continue
+		}
+		for _, f := range tp.files {
+			if f.copied {
+				continue
+			}
+			abs, err := filepath.Abs(f.path)
+			if err != nil {
+				return "", err
+			}
+			if f.orphan {
+				// an empty replacement deletes the file
+				ov.Replace[abs] = ""
+				continue
+			}
+			backing := filepath.Join(tmp, fmt.Sprintf("%d_%s", len(ov.Replace), filepath.Base(f.path)))
+			err = ioutil.WriteFile(backing, f.data, 0666)
+			if err != nil {
+				return "", err
+			}
+			ov.Replace[abs] = backing
+			t.add(abs, f.pos)
+			t.add(backing, f.pos)
+		}
+	}
+
+	if failed > 0 {
+		return "", fmt.Errorf("%d of %d packages failed", failed, len(dirs))
+	}
+
+	b, err := json.Marshal(ov)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(tmp, "overlay.json")
+	return path, ioutil.WriteFile(path, b, 0666)
+}
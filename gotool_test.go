@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseGoArgs(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []string
+		want goArgs
+	}{
+		{"build", nil, goArgs{}},
+		{"build", []string{"-o", "bin", "../other", "./...", "example.com/m/pkg"}, goArgs{dirs: []string{"../other", "./..."}, paths: []string{"example.com/m/pkg"}}},
+		{"test", []string{"-run", "TestFoo", "-tags=a,b", "./pkg", "-v"}, goArgs{dirs: []string{"./pkg"}, tags: "a,b", tagsSet: true}},
+		{"test", []string{"-tags", "", ".", "-args", "../x"}, goArgs{dirs: []string{"."}, tagsSet: true}},
+		{"run", []string{"-race", "../cmd/tool", "./arg"}, goArgs{dirs: []string{"../cmd/tool"}}},
+		{"run", []string{"main.go", "../lib/util.go", "arg.go2", "x.go"}, goArgs{dirs: []string{".", "../lib"}}},
+		{"vet", []string{"..", "std"}, goArgs{dirs: []string{".."}, paths: []string{"std"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseGoArgs(tt.cmd, tt.args)
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.cmd, tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %q: got %+v, want %+v", tt.cmd, tt.args, got, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{{"-C", "dir", "."}, {"-overlay=o.json"}} {
+		if _, err := parseGoArgs("build", args); err == nil {
+			t.Errorf("build %q: got no error", args)
+		}
+	}
+}
+
+func TestGoDirs(t *testing.T) {
+	// the main package imports a, which imports c through b, which has
+	// no .go2 files, and d is broken, but only imported by e
+	dir := tempPkg(t, map[string]string{
+		"go.mod":  "module m\n",
+		"main.go": "package main\n\nimport _ \"m/a\"\n\nfunc main() {}\n",
+		"a/a.go2": "package a\n\nimport _ \"m/b\"\n",
+		"b/b.go":  "package b\n\nimport (\n\t_ \"fmt\"\n\t_ \"m/c\"\n)\n",
+		"c/c.go2": "package c\n",
+		"d/d.go2": "package d\n\nfunc f() { check }\n",
+		"e/e.go":  "package e\n\nimport _ \"m/d\"\n",
+	})
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ga   goArgs
+		want []string
+	}{
+		{goArgs{}, []string{"a", "c"}},
+		{goArgs{dirs: []string{"./b"}}, []string{"c"}},
+		{goArgs{dirs: []string{"./e", "./missing"}}, []string{"d"}},
+		{goArgs{paths: []string{"m/b", "fmt"}}, []string{"c"}},
+		{goArgs{paths: []string{"m/..."}}, []string{"a", "c", "d"}},
+		{goArgs{dirs: []string{"./..."}}, []string{"a", "c", "d"}},
+	}
+	for _, tt := range tests {
+		got, err := goDirs(tt.ga)
+		if err != nil {
+			t.Errorf("%+v: %v", tt.ga, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.ga, got, tt.want)
+		}
+	}
+}
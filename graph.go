@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// transpiled is the outcome of transpiling the package in dir.
+type transpiled struct {
+	dir   string
+	files []outputFile
+	err   error
+
+	// warnings are found once the package is parsed, and are
+	// reported whether or not it transpiles.
+	warnings diagnostics
+
+	// path is the import path of the package, and imports the paths that
+	// it and its external tests import, once the package is parsed.
+	path    string
+	imports []string
+}
+
+// transpileAll transpiles the packages in dirs without writing anything,
+// and returns the outcomes in the same order.
+//
+// A package importing another one of dirs is type-checked against that
+// package as transformed, rather than against its generated files, which
+// may be stale or missing. Packages are therefore transformed after the
+// packages they import, and import cycles between them are reported.
+// Packages that don't depend on each other are transpiled in parallel.
+// Every package is attempted, except those importing a package that fails.
+// Packages found in the cache are only transformed if a package importing
+// them is. A package whose generated files would overwrite files that
+// go2gen didn't generate fails. The orphaned generated files of a package
+// are returned to be removed, and those of .go2 files that the build
+// constraints leave out are warned about, since they can't be checked.
+func transpileAll(dirs []string) []transpiled {
+	results := make([]transpiled, len(dirs))
+	pkgs := make([]*go2Package, len(dirs))
+	parallel(len(dirs), nil, func(i int) {
+		results[i].dir = dirs[i]
+		results[i].err = protect(dirs[i], func() error {
+			p, err := parsePkg(dirs[i])
+			if err != nil {
+				return err
+			}
+			results[i].warnings, err = excludedOutputs(p)
+			if err != nil {
+				return err
+			}
+			pkgs[i] = p
+			return nil
+		})
+	})
+
+	byPath := make(map[string]int)
+	for i, p := range pkgs {
+		if p == nil {
+			continue
+		}
+		files := p.files()
+		if p.xtest != nil {
+			files = append(files, p.xtest.files()...)
+		}
+		results[i].path, results[i].imports = p.path, importPaths(p.path, files)
+		if p.path != "" {
+			byPath[p.path] = i
+		}
+	}
+	err := shareImporters(pkgs, byPath)
+	if err != nil {
+		for i := range results {
+			if results[i].err == nil {
+				results[i].err = err
+			}
+		}
+		return results
+	}
+
+	order, cycles := sortPackages(pkgs, byPath)
+	for i, diags := range cycles {
+		results[i].err = diags
+	}
+
+	keys := make([]string, len(pkgs))
+	pathKeys := make(map[string]string)
+	for _, i := range order {
+		if results[i].err == nil {
+			keys[i] = cacheKey(pkgs[i], pathKeys)
+		}
+		if pkgs[i].path != "" {
+			pathKeys[pkgs[i].path] = keys[i]
+		}
+	}
+
+	// the cached packages are skipped, unless a package that is
+	// transformed imports them, and has to be type-checked against them
+	cached := make([][]outputFile, len(pkgs))
+	imported := make([]bool, len(pkgs))
+	for k := len(order) - 1; k >= 0; k-- {
+		i := order[k]
+		if keys[i] != "" && !imported[i] {
+			if files, ok := cacheGet(keys[i]); ok {
+				cached[i] = files
+				continue
+			}
+		}
+		p := pkgs[i]
+		files := p.files()
+		if p.xtest != nil {
+			files = append(files, p.xtest.files()...)
+		}
+		for _, path := range importPaths(p.path, files) {
+			if j, ok := byPath[path]; ok {
+				imported[j] = true
+			}
+		}
+	}
+
+	// a package is transformed once the packages it imports are
+	after := make([][]int, len(pkgs))
+	for i, p := range pkgs {
+		if results[i].err != nil || cached[i] != nil {
+			continue
+		}
+		for _, path := range importPaths(p.path, p.files()) {
+			if j, ok := byPath[path]; ok {
+				after[i] = append(after[i], j)
+			}
+		}
+	}
+	parallel(len(pkgs), after, func(i int) {
+		p := pkgs[i]
+		if results[i].err != nil || cached[i] != nil {
+			return
+		}
+		if diags := failedImports(p, byPath, results); len(diags) > 0 {
+			results[i].err = diags
+			return
+		}
+		results[i].err = protect(p.dir, func() error {
+			err := transform(p)
+			if err != nil {
+				return err
+			}
+			if p.path != "" {
+				p.imports.local.set(p.path, p.exportTypes())
+			}
+			return nil
+		})
+	})
+
+	// the external tests may import any package, so they
+	// are only transformed once every package has been
+	transformed := append([]transpiled(nil), results...)
+	parallel(len(pkgs), nil, func(i int) {
+		p := pkgs[i]
+		if results[i].err != nil {
+			return
+		}
+		if cached[i] != nil {
+			results[i].files = cached[i]
+		} else {
+			results[i].err = protect(p.dir, func() error {
+				if p.xtest != nil {
+					if diags := failedImports(p.xtest, byPath, transformed); len(diags) > 0 {
+						return diags
+					}
+					err := transform(p.xtest)
+					if err != nil {
+						return err
+					}
+				}
+				dst, err := outputDir(p.dir)
+				if err != nil {
+					return err
+				}
+				results[i].files, err = render(p, dst)
+				if err == nil && keys[i] != "" {
+					cachePut(keys[i], results[i].files)
+				}
+				return err
+			})
+		}
+		if results[i].err != nil {
+			return
+		}
+		if diags := conflicts(results[i].files); len(diags) > 0 {
+			results[i].files, results[i].err = nil, diags
+			return
+		}
+		orphaned, err := orphans(p.dir)
+		if err != nil {
+			results[i].files, results[i].err = nil, err
+			return
+		}
+		results[i].files = append(results[i].files, orphaned...)
+	})
+	return results
+}
+
+// parallel calls f for every index up to n, making up to -j calls at once.
+// If after isn't nil, the call for i only starts once the calls for the
+// indexes in after[i] have returned.
+func parallel(n int, after [][]int, f func(i int)) {
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	sem := make(chan struct{}, *jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer close(done[i])
+			if after != nil {
+				for _, j := range after[i] {
+					<-done[j]
+				}
+			}
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// protect calls f, and reports a panic in it as an internal error in the
+// package in dir. transform reports its own panics with the position of
+// the check it was working on.
+func protect(dir string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = internalError(token.Position{Filename: dir}, r)
+		}
+	}()
+	return f()
+}
+
+// shareImporters gives the packages in the same module a single importer,
+// so that the packages they import are loaded once, and are the same for
+// all of them. The packages in byPath are left to the local packages of
+// the importers.
+func shareImporters(pkgs []*go2Package, byPath map[string]int) error {
+	var localPaths []string
+	for path := range byPath {
+		localPaths = append(localPaths, path)
+	}
+	local := newLocalPackages(localPaths)
+
+	type module struct {
+		dir   string
+		files [][]*ast.File
+	}
+	modules := make(map[string]*module)
+	var roots []string
+	rootOf := make(map[*go2Package]string)
+	for _, p := range pkgs {
+		if p == nil {
+			continue
+		}
+		abs, err := filepath.Abs(p.dir)
+		if err != nil {
+			return err
+		}
+		root, _, err := moduleRoot(abs)
+		if err != nil {
+			return err
+		}
+		m, ok := modules[root]
+		if !ok {
+			m = &module{dir: p.dir}
+			modules[root] = m
+			roots = append(roots, root)
+		}
+		m.files = append(m.files, p.files())
+		if p.xtest != nil {
+			m.files = append(m.files, p.xtest.files())
+		}
+		rootOf[p] = root
+	}
+
+	importers := make(map[string]*packagesImporter)
+	for _, root := range roots {
+		m := modules[root]
+		var paths []string
+		for _, path := range importPaths("", m.files...) {
+			if _, ok := local.lookup(path); !ok {
+				paths = append(paths, path)
+			}
+		}
+		imp := newPackagesImporter(m.dir, token.NewFileSet(), paths)
+		imp.local = local
+		importers[root] = imp
+	}
+
+	for _, p := range pkgs {
+		if p == nil {
+			continue
+		}
+		p.imports = importers[rootOf[p]]
+		p.importer = p.imports
+		if p.xtest != nil {
+			p.xtest.imports = p.imports
+			p.xtest.importer = &pkgImporter{p.importer, p}
+		}
+	}
+	return nil
+}
+
+// sortPackages returns the indexes of pkgs in an order in which every
+// package comes after the packages it imports, leaving out the missing
+// packages, and the diagnostics of the packages in import cycles.
+func sortPackages(pkgs []*go2Package, byPath map[string]int) ([]int, map[int]diagnostics) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(pkgs))
+	cycles := make(map[int]diagnostics)
+	var order, stack []int
+
+	var visit func(i int)
+	visit = func(i int) {
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, path := range importPaths(pkgs[i].path, pkgs[i].files()) {
+			j, ok := byPath[path]
+			if !ok {
+				continue
+			}
+			switch state[j] {
+			case unvisited:
+				visit(j)
+			case visiting:
+				for k, start := range stack {
+					if start == j {
+						reportCycle(pkgs, stack[k:], cycles)
+						break
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = visited
+		order = append(order, i)
+	}
+	for i, p := range pkgs {
+		if p != nil && state[i] == unvisited {
+			visit(i)
+		}
+	}
+	return order, cycles
+}
+
+// reportCycle adds a diagnostic to cycles for every package in cycle,
+// at its import of the next one, unless it already has one.
+func reportCycle(pkgs []*go2Package, cycle []int, cycles map[int]diagnostics) {
+	for k, i := range cycle {
+		if _, ok := cycles[i]; ok {
+			continue
+		}
+		paths := make([]string, 0, len(cycle)+1)
+		for n := 0; n <= len(cycle); n++ {
+			paths = append(paths, pkgs[cycle[(k+n)%len(cycle)]].path)
+		}
+		next := paths[1]
+		msg := "import cycle not allowed: " + strings.Join(paths, " imports ")
+		cycles[i] = diagnostics{newDiagnostic(pkgs[i].importPos(next), codeImport, msg)}
+	}
+}
+
+// failedImports reports the imports of p among the packages in byPath
+// that failed to transpile.
+func failedImports(p *go2Package, byPath map[string]int, results []transpiled) diagnostics {
+	var diags diagnostics
+	for _, path := range importPaths(p.path, p.files()) {
+		j, ok := byPath[path]
+		if !ok || results[j].err == nil {
+			continue
+		}
+		msg := fmt.Sprintf("can't import %q: it failed to transpile", path)
+		diags = append(diags, newDiagnostic(p.importPos(path), codeImport, msg))
+	}
+	sortDiagnostics(diags)
+	return diags
+}
+
+// importPos returns the position of the first import of path in p.
+func (p *go2Package) importPos(path string) token.Position {
+	for _, f := range p.files() {
+		for _, spec := range f.Imports {
+			if s, err := strconv.Unquote(spec.Path.Value); err == nil && s == path {
+				return p.position(spec.Path.Pos())
+			}
+		}
+	}
+	return token.Position{Filename: p.dir}
+}
+
+// exportTypes type-checks the files of p other than its tests, giving the
+// package that the packages importing p see.
+func (p *go2Package) exportTypes() *types.Package {
+	var files []*ast.File
+	for _, f := range p.goFiles {
+		name := filepath.Base(p.fset.File(f.Pos()).Name())
+		if !strings.HasSuffix(name, "_test.go") {
+			files = append(files, f)
+		}
+	}
+	for _, gf := range p.go2Files {
+		if !strings.HasSuffix(gf.name, "_test") {
+			files = append(files, gf.f)
+		}
+	}
+	cfg := &types.Config{
+		// errors were reported when p was transformed
+		Error:       func(error) {},
+		Importer:    p.importer,
+		FakeImportC: true,
+	}
+	pkg, _ := cfg.Check(p.path, p.fset, files, nil)
+	return pkg
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTranspileAllOrder(t *testing.T) {
+	dir := tempPkg(t, map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"a/a.go2": "package a\n\nimport \"example.com/m/b\"\n\nfunc F() (int, error) {\n\tn := check b.Atoi(\"1\")\n\treturn n, nil\n}\n",
+		"b/b.go2": "package b\n\nimport \"strconv\"\n\nfunc Atoi(s string) (int, error) {\n\tn := check strconv.Atoi(s)\n\treturn n, nil\n}\n",
+	})
+	defer os.RemoveAll(dir)
+
+	// a comes first, and b has no generated files to load
+	results := transpileAll([]string{filepath.Join(dir, "a"), filepath.Join(dir, "b")})
+	for _, r := range results {
+		if r.err != nil {
+			t.Fatalf("%s: %v", r.dir, r.err)
+		}
+	}
+	for _, f := range results[0].files {
+		if filepath.Base(f.path) == "a.go" && !strings.Contains(string(f.data), "_go2int0, _go2error0 := b.Atoi(\"1\")") {
+			t.Errorf("check on b.Atoi wasn't typed:\n%s", f.data)
+		}
+	}
+}
+
+func TestTranspileAllCycle(t *testing.T) {
+	dir := tempPkg(t, map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"a/a.go2": "package a\n\nimport \"example.com/m/b\"\n\nvar X = b.Y\n",
+		"b/b.go2": "package b\n\nimport \"example.com/m/a\"\n\nvar Y = a.X\n",
+		"c/c.go2": "package c\n\nimport \"example.com/m/a\"\n\nvar Z = a.X\n",
+	})
+	defer os.RemoveAll(dir)
+
+	results := transpileAll([]string{filepath.Join(dir, "c"), filepath.Join(dir, "a"), filepath.Join(dir, "b")})
+	want := []string{
+		`can't import "example.com/m/a": it failed to transpile`,
+		"import cycle not allowed: example.com/m/a imports example.com/m/b imports example.com/m/a",
+		"import cycle not allowed: example.com/m/b imports example.com/m/a imports example.com/m/b",
+	}
+	for i, r := range results {
+		diags, ok := r.err.(diagnostics)
+		if !ok || len(diags) != 1 {
+			t.Errorf("%s: got %v, want one diagnostic", r.dir, r.err)
+			continue
+		}
+		d := diags[0]
+		if d.Line != 3 || d.Column != 8 || d.Code != codeImport || d.Message != want[i] {
+			t.Errorf("%s: got %v (%s), want 3:8: %s (%s)", r.dir, d, d.Code, want[i], codeImport)
+		}
+	}
+}
+
+func TestTranspileAllParallel(t *testing.T) {
+	defer func(j int) { *jobs = j }(*jobs)
+	*jobs = 4
+
+	// every other package imports the one before it
+	files := map[string]string{"go.mod": "module example.com/m\n"}
+	var dirs []string
+	for i := 0; i < 8; i++ {
+		src := fmt.Sprintf("package p%d\n\nimport \"strconv\"\n\nfunc F(s string) (int, error) {\n\tn := check strconv.Atoi(s)\n\treturn n, nil\n}\n", i)
+		if i%2 == 1 {
+			src = fmt.Sprintf("package p%d\n\nimport \"example.com/m/p%d\"\n\nfunc F(s string) (int, error) {\n\tn := check p%d.F(s)\n\treturn n, nil\n}\n", i, i-1, i-1)
+		}
+		name := fmt.Sprintf("p%d", i)
+		files[name+"/"+name+".go2"] = src
+		dirs = append(dirs, name)
+	}
+	// p6 fails, and so does p7, which imports it
+	files["p6/p6.go2"] = "package p6\n\nfunc F(s string) (int, error) {\n\tn := check g(s)\n\treturn n, nil\n}\n"
+	dir := tempPkg(t, files)
+	defer os.RemoveAll(dir)
+	for i := range dirs {
+		dirs[i] = filepath.Join(dir, dirs[i])
+	}
+
+	for i, r := range transpileAll(dirs) {
+		if r.dir != dirs[i] {
+			t.Errorf("result %d is for %s, want %s", i, r.dir, dirs[i])
+		}
+		if (r.err != nil) != (i >= 6) {
+			t.Errorf("%s: got error %v", r.dir, r.err)
+		}
+	}
+}
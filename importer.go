@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// pkgImporter imports the package being transpiled from its most
+// recent type-check, and every other package with fallback.
+type pkgImporter struct {
+	fallback types.Importer
+	pkg      *go2Package
+}
+
+func (imp *pkgImporter) Import(path string) (*types.Package, error) {
+	if path == imp.pkg.path && imp.pkg.types != nil {
+		return imp.pkg.types, nil
+	}
+	return imp.fallback.Import(path)
+}
+
+// importPath returns the import path of the package in dir, from the
+// go.mod file of its module, or from GOPATH if there is none. It returns
+// "" if neither applies.
+func importPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	root, mod, err := moduleRoot(abs)
+	if err != nil {
+		return "", err
+	}
+	if root != "" {
+		rel, err := filepath.Rel(root, abs)
+		if err != nil {
+			return "", err
+		}
+		return path.Join(modulePath(mod), filepath.ToSlash(rel)), nil
+	}
+
+	bp, err := buildContext().ImportDir(abs, build.FindOnly)
+	if err != nil || bp.ImportPath == "." {
+		return "", nil
+	}
+	return bp.ImportPath, nil
+}
+
+// moduleRoot returns the directory of the module containing the absolute
+// directory dir, and the contents of its go.mod file. It returns "" if
+// dir isn't in a module.
+func moduleRoot(dir string) (string, []byte, error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		b, err := ioutil.ReadFile(filepath.Join(d, "go.mod"))
+		if err == nil {
+			return d, b, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+		if filepath.Dir(d) == d {
+			return "", nil, nil
+		}
+	}
+}
+
+// modulePath returns the module path declared in the go.mod file mod.
+func modulePath(mod []byte) string {
+	for _, line := range strings.Split(string(mod), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "module" {
+			continue
+		}
+		if p, err := strconv.Unquote(fields[1]); err == nil {
+			return p
+		}
+		return fields[1]
+	}
+	return ""
+}
+
+// packagesImporter imports packages from their export data, as loaded by
+// go/packages from the directory of the package being transpiled. Imports
+// thus resolve as they do for the go command there, including modules,
+// replace directives and workspaces. Every import of the package is
+// loaded at once, on first use.
+type packagesImporter struct {
+	dir   string
+	fset  *token.FileSet
+	paths []string
+
+	// local holds the packages transpiled along with the importing one,
+	// which aren't loaded: they are type-checked from their transformed
+	// files instead, as their generated files may be missing or stale.
+	local *localPackages
+
+	once    sync.Once
+	pkgs    map[string]*types.Package
+	exports map[string]string // path -> export data file
+	errs    map[string]error
+}
+
+func newPackagesImporter(dir string, fset *token.FileSet, paths []string) *packagesImporter {
+	return &packagesImporter{dir: dir, fset: fset, paths: paths}
+}
+
+func (imp *packagesImporter) Import(path string) (*types.Package, error) {
+	if pkg, ok := imp.local.lookup(path); ok {
+		if pkg == nil {
+			return nil, fmt.Errorf("package %s hasn't been transpiled", path)
+		}
+		return pkg, nil
+	}
+	imp.once.Do(imp.load)
+	if pkg, ok := imp.pkgs[path]; ok {
+		return pkg, nil
+	}
+	if err, ok := imp.errs[path]; ok {
+		return nil, err
+	}
+	return nil, fmt.Errorf("package %s isn't imported by any file", path)
+}
+
+// err returns the reason path, which is imported by a file of the
+// package, couldn't be loaded, or nil if it could be.
+func (imp *packagesImporter) err(path string) error {
+	if _, ok := imp.local.lookup(path); ok {
+		return nil
+	}
+	imp.once.Do(imp.load)
+	return imp.errs[path]
+}
+
+// exportFile returns the file holding the export data of path, which is
+// imported by a file of the package, or "" if it couldn't be loaded.
+func (imp *packagesImporter) exportFile(path string) string {
+	imp.once.Do(imp.load)
+	return imp.exports[path]
+}
+
+func (imp *packagesImporter) load() {
+	imp.pkgs = make(map[string]*types.Package)
+	imp.exports = make(map[string]string)
+	imp.errs = make(map[string]error)
+	if len(imp.paths) == 0 {
+		return
+	}
+
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedTypes | packages.NeedImports | packages.NeedExportFile,
+		Dir:  imp.dir,
+		Fset: imp.fset,
+	}
+	if *buildTags != "" {
+		cfg.BuildFlags = []string{"-tags=" + *buildTags}
+	}
+	pkgs, err := packages.Load(cfg, imp.paths...)
+	if err != nil {
+		for _, path := range imp.paths {
+			imp.errs[path] = err
+		}
+		return
+	}
+	for _, pkg := range pkgs {
+		// packages that can't be found have no PkgPath
+		path := pkg.PkgPath
+		if path == "" {
+			path = pkg.ID
+		}
+		if len(pkg.Errors) > 0 {
+			imp.errs[path] = errors.New(pkg.Errors[0].Msg)
+			continue
+		}
+		imp.pkgs[path] = pkg.Types
+		imp.exports[path] = pkg.ExportFile
+	}
+	for _, path := range imp.paths {
+		if imp.pkgs[path] == nil && imp.errs[path] == nil {
+			imp.errs[path] = fmt.Errorf("package %s not found", path)
+		}
+	}
+}
+
+// localPackages holds the packages transpiled together, by import path.
+// They are used by several packages at once, which are transpiled in
+// parallel. A package is nil until it has been transformed.
+type localPackages struct {
+	mu   sync.Mutex
+	pkgs map[string]*types.Package
+}
+
+func newLocalPackages(paths []string) *localPackages {
+	l := &localPackages{pkgs: make(map[string]*types.Package)}
+	for _, path := range paths {
+		l.pkgs[path] = nil
+	}
+	return l
+}
+
+// lookup returns the package path, and whether it is one of l.
+func (l *localPackages) lookup(path string) (*types.Package, bool) {
+	if l == nil {
+		return nil, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pkg, ok := l.pkgs[path]
+	return pkg, ok
+}
+
+func (l *localPackages) set(path string, pkg *types.Package) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pkgs[path] = pkg
+}
+
+// importPaths returns the paths imported by files, sorted, except for
+// "C", and for the package itself, which external tests import.
+func importPaths(self string, files ...[]*ast.File) []string {
+	seen := map[string]bool{"C": true, "unsafe": true, self: true}
+	var paths []string
+	for _, fs := range files {
+		for _, f := range fs {
+			for _, spec := range f.Imports {
+				path, err := strconv.Unquote(spec.Path.Value)
+				if err != nil || seen[path] {
+					continue
+				}
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
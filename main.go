@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"path"
+	"runtime"
 )
 
 const (
@@ -15,52 +18,198 @@ const (
 	generatedComment = "// generated by go2gen; DO NOT EDIT"
 )
 
+var (
+	outDir     = flag.String("o", "", "write transpiled packages under `dir`, mirroring the source layout")
+	namePat    = flag.String("name", "%s.go", "name generated files after `pattern`, in which %s is the name of the .go2 file")
+	verifyOnly = flag.Bool("verify", false, "check that generated files are up to date without writing them")
+	watchMode  = flag.Bool("watch", false, "keep running, and regenerate packages when their source files change")
+
+	lineDirectives = flag.Bool("line", false, "emit //line directives, so that compilers, debuggers and stack traces report .go2 positions")
+	sourceMaps     = flag.Bool("map", false, "write a foo.go2.map source map next to each generated file")
+	jsonOutput     = flag.Bool("json", false, "print diagnostics as a stream of JSON objects on standard output")
+
+	buildTags = flag.String("tags", "", "a comma-separated list of build `tags` to consider satisfied when selecting files")
+	jobs      = flag.Int("j", runtime.GOMAXPROCS(0), "the number of packages that can be transpiled in parallel")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: go2gen [-o dir] [-name pattern] [-j n] [-line] [-map] [-json] [-verify | -watch] [packages]\n\n")
+	fmt.Fprintf(os.Stderr, "Packages are directories, or patterns ending in ... such as ./...\n")
+	fmt.Fprintf(os.Stderr, "If no packages are given, the current directory is used.\n\n")
+	fmt.Fprintf(os.Stderr, "       go2gen build|run|test|vet [go flags] [packages]\n\n")
+	fmt.Fprintf(os.Stderr, "Runs the go command on the packages under the current directory,\n")
+	fmt.Fprintf(os.Stderr, "with .go2 files transpiled in memory instead of written to disk.\n")
+	fmt.Fprintf(os.Stderr, "Positions in generated files are reported as .go2 positions.\n\n")
+	fmt.Fprintf(os.Stderr, "       go2gen positions [packages]\n\n")
+	fmt.Fprintf(os.Stderr, "Copies standard input to standard output, rewriting file:line:col\n")
+	fmt.Fprintf(os.Stderr, "references to generated files into .go2 positions. By default,\n")
+	fmt.Fprintf(os.Stderr, "the packages under the current directory are considered.\n\n")
+	fmt.Fprintf(os.Stderr, "       go2gen [-o dir] clean [packages]\n\n")
+	fmt.Fprintf(os.Stderr, "Removes the files generated for the packages, including those\n")
+	fmt.Fprintf(os.Stderr, "whose .go2 file is gone. Patterns ending in ... match every\n")
+	fmt.Fprintf(os.Stderr, "directory, not only those with .go2 files.\n\n")
+	fmt.Fprintf(os.Stderr, "       go2gen map FILE:LINE[:COL]...\n\n")
+	fmt.Fprintf(os.Stderr, "Prints the .go2 position of a position in a generated file,\n")
+	fmt.Fprintf(os.Stderr, "or the generated positions of a position in a .go2 file.\n\n")
+	flag.PrintDefaults()
+}
+
 func main() {
-	var dir string
-	var err error
-	if len(os.Args) > 1 {
-		dir = os.Args[1]
-	} else {
-		dir, err = os.Getwd()
+	log.SetFlags(0)
+	log.SetPrefix("go2gen: ")
+	flag.Usage = usage
+	flag.Parse()
+	if *jobs < 1 {
+		log.Fatal("-j must be at least 1")
+	}
+	if err := checkNamePattern(*namePat); err != nil {
+		log.Fatal(err)
+	}
+
+	patterns := flag.Args()
+	if len(patterns) > 0 && goCommands[patterns[0]] {
+		code, err := runGo(patterns[0], patterns[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(code)
+	}
+	if len(patterns) > 0 && patterns[0] == "positions" {
+		err := translatePositions(patterns[1:])
 		if err != nil {
 			log.Fatal(err)
 		}
+		return
 	}
-	err = generate(dir)
+	if len(patterns) > 0 && patterns[0] == "clean" {
+		err := clean(patterns[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(patterns) > 0 && patterns[0] == "map" {
+		err := queryMap(patterns[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	if *watchMode {
+		if *verifyOnly {
+			log.Fatal("-watch and -verify can't be used together")
+		}
+		log.Fatal(watch(patterns))
+	}
+
+	dirs, err := expandPatterns(patterns)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if *verifyOnly {
+		runVerify(dirs)
+		return
+	}
+
+	// keep going after a failure so that every broken package is reported
+	failed := 0
+	for _, t := range transpileAll(dirs) {
+		if len(t.warnings) > 0 {
+			report(t.dir, t.warnings)
+		}
+		err := t.err
+		if err == nil {
+			err = writeFiles(t.files)
+		}
+		if err != nil {
+			report(t.dir, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d packages failed", failed, len(dirs))
+	}
 }
 
-func generate(dir string) error {
-	pkg, err := parsePkg(dir)
-	if err != nil {
-		return err
+func runVerify(dirs []string) {
+	failed, stale := 0, 0
+	for _, t := range transpileAll(dirs) {
+		if len(t.warnings) > 0 {
+			report(t.dir, t.warnings)
+		}
+		if t.err != nil {
+			report(t.dir, t.err)
+			failed++
+			continue
+		}
+		ok, err := verify(t.dir, t.files)
+		if err != nil {
+			report(t.dir, err)
+			failed++
+			continue
+		}
+		if !ok {
+			stale++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d packages failed", failed, len(dirs))
 	}
+	if stale > 0 {
+		log.Fatalf("%d of %d packages have stale generated files", stale, len(dirs))
+	}
+}
 
-	err = transform(pkg)
+func generate(dir string) error {
+	files, err := transpile(dir)
 	if err != nil {
 		return err
 	}
+	return writeFiles(files)
+}
 
-	for _, gf := range pkg.go2Files {
-		w, err := os.Create(path.Join(dir, gf.name) + ".go")
-		if err != nil {
-			return err
+// transpile returns the files making up the transpiled package in dir,
+// without writing anything.
+func transpile(dir string) ([]outputFile, error) {
+	t := transpileAll([]string{dir})[0]
+	return t.files, t.err
+}
+
+// verify reports whether the files on disk for the package in dir are up to
+// date with files, printing a diff for every file that isn't.
+func verify(dir string, files []outputFile) (bool, error) {
+	upToDate := true
+	for _, f := range files {
+		if f.copied && *outDir == "" {
+			continue
 		}
-		_, err = w.WriteString(generatedComment + "\n\n")
-		if err != nil {
-			return err
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
 		}
-		str, err := gf.string()
-		if err != nil {
-			return err
+		diff := unifiedDiff(f.path, f.path+" (go2gen)", string(b), string(f.data))
+		if diff == "" && !(f.orphan && err == nil) {
+			continue
 		}
-		_, err = w.WriteString(str)
-		if err != nil {
-			return err
+		upToDate = false
+		if *jsonOutput {
+			msg := "generated file is out of date"
+			if f.orphan {
+				msg = "generated file has no .go2 source, and is to be removed"
+			}
+			report(dir, diagnostics{{
+				File:     f.path,
+				Severity: severityError,
+				Code:     codeStale,
+				Message:  msg,
+			}})
+			continue
 		}
+		fmt.Print(diff)
 	}
-
-	return nil
+	return upToDate, nil
 }
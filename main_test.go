@@ -54,11 +54,12 @@ func TestMain(t *testing.T) {
 			inputGo2[name] = true
 		}
 	}
+	// remove all .go files that correspond with .go2 files, if they exist
 	for goName := range inputGo {
 		if inputGo2[goName+"2"] {
-			_go2error0 := os.Remove(path.Join(testInputDir, goName))
-			if _go2error0 != nil {
-				fmt.Println(_go2error0)
+			_go2error4 := os.Remove(path.Join(testInputDir, goName))
+			if _go2error4 != nil {
+				fmt.Println(_go2error4)
 				t.FailNow()
 				return
 			}
@@ -71,16 +72,16 @@ func TestMain(t *testing.T) {
 		return
 	}
 	for _, name := range outputNames {
-		_go2slcByte0, _go2error0 := ioutil.ReadFile(path.Join(testInputDir, name))
-		if _go2error0 != nil {
-			fmt.Println(_go2error0)
+		_go2slcByte0, _go2error5 := ioutil.ReadFile(path.Join(testInputDir, name))
+		if _go2error5 != nil {
+			fmt.Println(_go2error5)
 			t.FailNow()
 			return
 		}
 		result := string(_go2slcByte0)
-		_go2slcByte1, _go2error1 := ioutil.ReadFile(path.Join(testOutputDir, name))
-		if _go2error1 != nil {
-			fmt.Println(_go2error1)
+		_go2slcByte1, _go2error6 := ioutil.ReadFile(path.Join(testOutputDir, name))
+		if _go2error6 != nil {
+			fmt.Println(_go2error6)
 			t.FailNow()
 			return
 		}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// outputFile is a file of a transpiled package.
+type outputFile struct {
+	path string
+	data []byte
+
+	// copied is true for hand-written .go files, which only
+	// need to be written when the output is out of tree.
+	copied bool
+
+	// pos maps generated files back to their .go2 source.
+	pos *posMap
+
+	// orphan is true for generated files whose .go2 source is
+	// gone, which are removed rather than written.
+	orphan bool
+}
+
+// outputDir returns the directory that the package in dir is written to.
+// By default that is dir itself; with -o, it is the same relative
+// path under the output directory.
+func outputDir(dir string) (string, error) {
+	if *outDir == "" {
+		return dir, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the current directory; can't mirror it under %s", dir, *outDir)
+	}
+	return filepath.Join(*outDir, rel), nil
+}
+
+// render returns the files making up the transpiled package p,
+// including its external tests, in dst.
+func render(p *go2Package, dst string) ([]outputFile, error) {
+	var files []outputFile
+	owner := make(map[string]string) // output name -> source name
+
+	go2Files := p.go2Files
+	if p.xtest != nil {
+		go2Files = append(go2Files[:len(go2Files):len(go2Files)], p.xtest.go2Files...)
+	}
+
+	// every hand-written file is copied, including those of other
+	// platforms, so that the output is as complete as the source
+	_, handWritten, err := listFiles(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range handWritten {
+		name := filepath.Base(src)
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		owner[name] = name
+		files = append(files, outputFile{
+			path:   filepath.Join(dst, name),
+			data:   data,
+			copied: true,
+		})
+	}
+
+	for _, gf := range go2Files {
+		name := goFileName(gf.name)
+		if go2Name, ok := go2FileName(name); !ok || go2Name != gf.name {
+			msg := fmt.Sprintf("can't name the file generated from %s%s %s, which the go command would read differently; choose another -name", gf.name, extension, name)
+			return nil, diagnostics{{File: gf.path, Severity: severityError, Code: codeConflict, Message: msg}}
+		}
+		if prev, ok := owner[name]; ok {
+			msg := fmt.Sprintf("%s%s and %s both produce %s; choose another name for generated files with -name", gf.name, extension, prev, name)
+			return nil, diagnostics{{File: gf.path, Severity: severityError, Code: codeConflict, Message: msg}}
+		}
+		owner[name] = gf.name + extension
+		str, err := gf.string()
+		if err != nil {
+			return nil, err
+		}
+		data := []byte(generatedComment + "\n\n" + str)
+		path := filepath.Join(dst, name)
+		pm, err := buildPosMap(gf, path, data)
+		if err != nil {
+			return nil, err
+		}
+		if *lineDirectives {
+			go2Name, err := relPath(dst, gf.path)
+			if err != nil {
+				return nil, err
+			}
+			data = addLineDirectives(data, pm, go2Name)
+			pm, err = buildPosMap(gf, path, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		files = append(files, outputFile{
+			path: path,
+			data: data,
+			pos:  pm,
+		})
+
+		if *sourceMaps {
+			b, err := encodeSourceMap(pm, dst)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, outputFile{
+				path: filepath.Join(dst, mapFileName(gf.name+extension)),
+				data: b,
+			})
+		}
+	}
+
+	return files, nil
+}
+
+// orphans returns the generated files in dir, and in its output directory,
+// that have no .go2 source in dir, such as those of .go2 files that were
+// deleted or renamed, or those named after another -name pattern, the
+// source maps of earlier runs if -map is off, and the copies in the output
+// directory of hand-written files that were deleted.
+func orphans(dir string) ([]outputFile, error) {
+	dirs, err := withOutputDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []outputFile
+	for _, d := range dirs {
+		paths, copies, err := listFiles(d)
+		if err != nil {
+			return nil, err
+		}
+		if d != dir {
+			for _, path := range copies {
+				name := filepath.Base(path)
+				if exists(filepath.Join(dir, name)) {
+					continue
+				}
+				// a file generated in place of the copy replaces it
+				if go2Name, ok := go2FileName(name); ok && exists(filepath.Join(dir, go2Name+extension)) {
+					continue
+				}
+				files = append(files, outputFile{path: path, orphan: true})
+			}
+		}
+		for _, path := range paths {
+			name := filepath.Base(path)
+			var src string
+			if go2Name, ok := go2FileName(name); ok {
+				src = go2Name + extension
+			} else if strings.HasSuffix(name, mapFileName(extension)) && *sourceMaps {
+				src = strings.TrimSuffix(name, mapFileName(""))
+			}
+			if src != "" && exists(filepath.Join(dir, src)) {
+				continue
+			}
+			files = append(files, outputFile{path: path, orphan: true})
+		}
+	}
+	return files, nil
+}
+
+// excludedOutputs warns about the generated files of the .go2 files of p
+// that the build constraints leave out. They aren't regenerated, and can't
+// be verified, so they are stale once the .go2 file changes.
+func excludedOutputs(p *go2Package) (diagnostics, error) {
+	dirs, err := withOutputDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	var diags diagnostics
+	for _, name := range p.excluded {
+		for _, dir := range dirs {
+			path := filepath.Join(dir, goFileName(name))
+			generated, err := hasGeneratedHeader(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !generated {
+				continue
+			}
+			msg := fmt.Sprintf("%s%s is excluded by the build constraints, so %s isn't regenerated or verified; run go2gen with a GOOS, GOARCH or -tags that select it", name, extension, path)
+			diags = append(diags, diagnostic{File: filepath.Join(p.dir, name+extension), Severity: severityWarning, Code: codeExcluded, Message: msg})
+		}
+	}
+	return diags, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// withOutputDir returns dir, followed by its output directory if that's
+// another one.
+func withOutputDir(dir string) ([]string, error) {
+	dst, err := outputDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Clean(dst) == filepath.Clean(dir) {
+		return []string{dir}, nil
+	}
+	return []string{dir, dst}, nil
+}
+
+// generatedFiles returns the paths of the files in dir that go2gen
+// generated: the .go files starting with its header, and the source maps.
+// A missing dir has none.
+func generatedFiles(dir string) ([]string, error) {
+	generated, _, err := listFiles(dir)
+	return generated, err
+}
+
+// listFiles returns the paths of the files in dir that go2gen generated,
+// as generatedFiles does, and those of the other .go files, which are
+// hand-written in a source directory, and copies in an output directory.
+func listFiles(dir string) (generated, other []string, err error) {
+	d, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	infos, err := d.Readdir(0)
+	d.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(dir, name)
+		switch {
+		case info.IsDir():
+		case strings.HasSuffix(name, mapFileName(extension)):
+			generated = append(generated, path)
+		case filepath.Ext(name) == ".go":
+			isGen, err := hasGeneratedHeader(path)
+			if err != nil {
+				return nil, nil, err
+			}
+			if isGen {
+				generated = append(generated, path)
+			} else {
+				other = append(other, path)
+			}
+		}
+	}
+	return generated, other, nil
+}
+
+// clean removes the files that go2gen generated in the directories matching
+// patterns, and in their output directories, whether or not their .go2
+// files are still there.
+func clean(patterns []string) error {
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	dirs, err := expandDirs(patterns, func(string) (bool, error) { return true, nil })
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		withOut, err := withOutputDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, d := range withOut {
+			paths, err := generatedFiles(d)
+			if err != nil {
+				return err
+			}
+			for _, path := range paths {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// conflicts reports the files on disk that the generated files among files
+// would overwrite, but which go2gen didn't generate.
+func conflicts(files []outputFile) diagnostics {
+	var diags diagnostics
+	for _, f := range files {
+		if f.pos == nil {
+			continue
+		}
+		if generated, err := hasGeneratedHeader(f.path); err != nil || generated {
+			continue
+		}
+		// out of tree, a copy of a hand-written file that's gone
+		// is replaced; one that's still there conflicts in render
+		if *outDir != "" && !exists(filepath.Join(filepath.Dir(f.pos.go2Path), filepath.Base(f.path))) {
+			continue
+		}
+		msg := fmt.Sprintf("%s wasn't generated by go2gen, so it isn't overwritten; choose another name for generated files with -name", filepath.Base(f.path))
+		diags = append(diags, diagnostic{File: f.path, Severity: severityError, Code: codeConflict, Message: msg})
+	}
+	return diags
+}
+
+// writeFiles writes the rendered files of a package to disk, and removes
+// its orphans. Files that are already up to date are left untouched, so
+// that their modification times don't invalidate the go command's build
+// cache.
+func writeFiles(files []outputFile) error {
+	outOfTree := *outDir != ""
+	for _, f := range files {
+		if f.copied && !outOfTree {
+			continue
+		}
+		if f.orphan {
+			if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if old, err := ioutil.ReadFile(f.path); err == nil && bytes.Equal(old, f.data) {
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(f.path), 0777)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(f.path, f.data, 0666)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relPath returns the path of target relative to the directory base.
+func relPath(base, target string) (string, error) {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(absBase, absTarget)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joelterry/fun"
+)
+
+func TestOutputDir(t *testing.T) {
+	defer func(dir string) { *outDir = dir }(*outDir)
+
+	f := fun.Test(t, outputDir)
+
+	*outDir = ""
+	f.In("test/input").Out("test/input")
+
+	*outDir = "out"
+	f.In("test/input").Out("out/test/input")
+	f.In("./test/../test/input/").Out("out/test/input")
+	f.In(".").Out("out")
+	f.In("..").Err()
+}
+
+func TestWriteFilesUnchanged(t *testing.T) {
+	dir := tempPkg(t, map[string]string{"a.go": "package a\n"})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.go")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err := os.Chtimes(path, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := func() time.Time {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ModTime()
+	}
+
+	err = writeFiles([]outputFile{{path: path, data: []byte("package a\n")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modTime().Equal(old) {
+		t.Errorf("unchanged file was rewritten")
+	}
+
+	err = writeFiles([]outputFile{{path: path, data: []byte("package b\n")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "package b\n" {
+		t.Errorf("got %q, want the new content", b)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	defer func(pat string) { *namePat = pat }(*namePat)
+
+	// a.go is left out of the package by its build constraint,
+	// but would still be overwritten by the file generated from a.go2
+	dir := tempPkg(t, map[string]string{
+		"a.go2": "package a\n\nfunc A() {}\n",
+		"a.go":  "//go:build ignore\n\npackage main\n",
+		"b.go2": "package a\n\nfunc B() {}\n",
+		"c.go":  "package a\n",
+	})
+	defer os.RemoveAll(dir)
+
+	*namePat = "%s.go"
+	_, err := transpile(dir)
+	diags, ok := err.(diagnostics)
+	if !ok || len(diags) != 1 || diags[0].Code != codeConflict || filepath.Base(diags[0].File) != "a.go2" {
+		t.Fatalf("got %v, want a conflict for a.go2", err)
+	}
+
+	*namePat = "%s_go2.go"
+	files, err := transpile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f.path))
+	}
+	// a.go is still copied, as out of tree, the output is complete
+	if len(names) != 4 || names[0] != "a.go" || names[1] != "c.go" || names[2] != "a_go2.go" || names[3] != "b_go2.go" {
+		t.Errorf("got files %v, want a.go, c.go, a_go2.go and b_go2.go", names)
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	defer func(on bool) { *sourceMaps = on }(*sourceMaps)
+
+	// b.go and b.go2.map were generated from a b.go2 that is gone;
+	// b.go would break the package if it were parsed
+	dir := tempPkg(t, map[string]string{
+		"a.go2":     "package a\n\nfunc A() {}\n",
+		"a.go":      generatedComment + "\n\npackage a\n\nfunc A() {}\n",
+		"a.go2.map": "{}",
+		"b.go":      generatedComment + "\n\npackage b\n",
+		"b.go2.map": "{}",
+		"c.go":      "package a\n",
+	})
+	defer os.RemoveAll(dir)
+
+	orphans := func() []string {
+		t.Helper()
+		files, err := transpile(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var orphaned []string
+		for _, f := range files {
+			if f.orphan {
+				orphaned = append(orphaned, filepath.Base(f.path))
+			}
+		}
+		return orphaned
+	}
+
+	// a.go2.map is regenerated with -map
+	*sourceMaps = true
+	if orphaned := orphans(); len(orphaned) != 2 || orphaned[0] != "b.go" || orphaned[1] != "b.go2.map" {
+		t.Fatalf("got orphans %v, want b.go and b.go2.map", orphaned)
+	}
+
+	// and stale without it
+	*sourceMaps = false
+	if orphaned := orphans(); len(orphaned) != 3 || orphaned[0] != "a.go2.map" || orphaned[1] != "b.go" || orphaned[2] != "b.go2.map" {
+		t.Fatalf("got orphans %v, want a.go2.map, b.go and b.go2.map", orphaned)
+	}
+
+	files, err := transpile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"a.go": true, "a.go2.map": false, "b.go": false, "b.go2.map": false, "c.go": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s: got exists %v, want %v", name, err == nil, want)
+		}
+	}
+
+	// once its last .go2 file is gone, a directory only has orphans
+	gone := tempPkg(t, map[string]string{"b.go": generatedComment + "\n\npackage b\n"})
+	defer os.RemoveAll(gone)
+	files, err = transpile(gone)
+	if err != nil || len(files) != 1 || !files[0].orphan {
+		t.Errorf("got %v and %v, want b.go as an orphan", files, err)
+	}
+}
+
+func TestExcludedOutputs(t *testing.T) {
+	// b.go was generated from b.go2 with the never tag, which
+	// this run leaves out, and c.go2 has no generated file
+	dir := tempPkg(t, map[string]string{
+		"a.go2": "package a\n",
+		"b.go2": "//go:build never\n\npackage a\n\nconst B = 1\n",
+		"b.go":  generatedComment + "\n\n//go:build never\n\npackage a\n",
+		"c.go2": "//go:build never\n\npackage a\n",
+	})
+	defer os.RemoveAll(dir)
+
+	tp := transpileAll([]string{dir})[0]
+	if tp.err != nil {
+		t.Fatal(tp.err)
+	}
+	for _, f := range tp.files {
+		if f.orphan {
+			t.Errorf("got orphan %s, want none", f.path)
+		}
+	}
+	if len(tp.warnings) != 1 || tp.warnings[0].File != filepath.Join(dir, "b.go2") || tp.warnings[0].Code != codeExcluded {
+		t.Errorf("got warnings %v, want one about b.go2", tp.warnings)
+	}
+}
+
+func TestOrphanedCopies(t *testing.T) {
+	defer func(dir string) { *outDir = dir }(*outDir)
+
+	// out/src holds copies of b.go, which is still there, of helper.go,
+	// which was deleted, and of c.go, which was replaced by c.go2
+	dir := tempPkg(t, map[string]string{
+		"src/b.go":          "package a\n",
+		"src/c.go2":         "package a\n",
+		"out/src/b.go":      "package a\n",
+		"out/src/helper.go": "package a\n",
+		"out/src/c.go":      "package a\n",
+	})
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	*outDir = "out"
+	files, err := transpile("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orphaned []string
+	for _, f := range files {
+		if f.orphan {
+			orphaned = append(orphaned, f.path)
+		}
+	}
+	if want := filepath.Join("out", "src", "helper.go"); len(orphaned) != 1 || orphaned[0] != want {
+		t.Fatalf("got orphans %v, want %s", orphaned, want)
+	}
+
+	err = writeFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"b.go": true, "helper.go": false, "c.go": true} {
+		if _, err := os.Stat(filepath.Join("out", "src", name)); (err == nil) != want {
+			t.Errorf("%s: got exists %v, want %v", name, err == nil, want)
+		}
+	}
+	if generated, _ := hasGeneratedHeader(filepath.Join("out", "src", "c.go")); !generated {
+		t.Errorf("the copy of c.go wasn't replaced by the file generated from c.go2")
+	}
+}
+
+func TestClean(t *testing.T) {
+	dir := tempPkg(t, map[string]string{
+		"a.go2":         "package a\n",
+		"a.go":          generatedComment + "\n\npackage a\n",
+		"a.go2.map":     "{}",
+		"c.go":          "package a\n",
+		"sub/b.go":      generatedComment + "\n\npackage b\n",
+		"sub/d.go":      "package b\n",
+		"testdata/e.go": generatedComment + "\n\npackage e\n",
+	})
+	defer os.RemoveAll(dir)
+
+	err := clean([]string{dir + "/..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"a.go2": true, "a.go": false, "a.go2.map": false, "c.go": true,
+		"sub/b.go": false, "sub/d.go": true, "testdata/e.go": true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); (err == nil) != want {
+			t.Errorf("%s: got exists %v, want %v", name, err == nil, want)
+		}
+	}
+}
@@ -1,19 +1,41 @@
 package main
 
 import (
-	"errors"
+	"bytes"
+	"fmt"
 	"go/ast"
-	"go/importer"
+	"go/build"
 	"go/parser"
 	"go/token"
 	"go/types"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	go2parser "github.com/joelterry/go2gen/parser"
+	"golang.org/x/tools/go/ast/astutil"
 )
 
 type go2Package struct {
 	name string
+	dir  string
+
+	// path is the import path of the package, if known.
+	path string
+
+	// types is the package as of the last type-check.
+	types *types.Package
+
+	// xtest is the external test package (package foo_test)
+	// in the same directory, if any.
+	xtest *go2Package
+
+	importer types.Importer
+	imports  *packagesImporter // shared with xtest
 
 	fset *token.FileSet
 
@@ -24,32 +46,71 @@ type go2Package struct {
 	goFiles []*ast.File
 
 	go2Files []*go2File
+
+	// excluded are the names of the .go2 files in dir that the build
+	// constraints leave out, without their extension.
+	excluded []string
+}
+
+// buildContext returns the context that selects the files of a package:
+// the default context, which honors GOOS and GOARCH, plus the -tags.
+func buildContext() *build.Context {
+	ctxt := build.Default
+	tags := strings.FieldsFunc(*buildTags, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	ctxt.BuildTags = append(ctxt.BuildTags[:len(ctxt.BuildTags):len(ctxt.BuildTags)], tags...)
+	return &ctxt
+}
+
+// matchFile reports whether ctxt selects the file name in dir, by its name
+// and build constraints. A .go2 file is matched as the .go file it is
+// transpiled to.
+func matchFile(ctxt *build.Context, dir, name string) (bool, error) {
+	if path.Ext(name) != extension {
+		return ctxt.MatchFile(dir, name)
+	}
+	c := *ctxt
+	c.OpenFile = func(p string) (io.ReadCloser, error) {
+		return os.Open(strings.TrimSuffix(p, ".go") + extension)
+	}
+	return c.MatchFile(dir, strings.TrimSuffix(name, extension)+".go")
 }
 
+// parsedFile is a file parsed by parsePkg; gf is nil for .go files.
+type parsedFile struct {
+	name string // without extension
+	f    *ast.File
+	gf   *go2File
+}
+
+// isXTest reports whether pf can belong to an external test package.
+func (pf parsedFile) isXTest() bool {
+	return strings.HasSuffix(pf.name, "_test") && strings.HasSuffix(pf.f.Name.Name, "_test")
+}
+
+// parsePkg parses the .go and .go2 files in dirPath that the build context
+// selects. Like the go tool, _test files declaring package foo_test make up
+// the external test package, p.xtest. If any of the files can't be parsed,
+// the returned error is a list of diagnostics.
 func parsePkg(dirPath string) (*go2Package, error) {
-	pkgName := ""
+	ctxt := buildContext()
 
 	dir, err := os.Open(dirPath)
 	if err != nil {
 		return nil, err
 	}
 	files, err := dir.Readdirnames(0)
+	dir.Close()
 	if err != nil {
 		return nil, err
 	}
-
-	isGo2 := make(map[string]bool)
-	for _, file := range files {
-		ext := path.Ext(file)
-		name := file[0 : len(file)-len(ext)]
-		if ext == extension {
-			isGo2[name] = true
-		}
-	}
+	sort.Strings(files)
 
 	fset := token.NewFileSet()
-	var goFiles []*ast.File
-	var go2Files []*go2File
+	var parsed []parsedFile
+	var excluded []string
+	var diags diagnostics
 
 	for _, file := range files {
 
@@ -58,83 +119,186 @@ func parsePkg(dirPath string) (*go2Package, error) {
 		if ext != ".go" && ext != extension {
 			continue
 		}
-		// skip previously generated files
-		if ext == ".go" && isGo2[name] {
-			continue
-		}
 
 		fullPath := path.Join(dirPath, file)
 
-		if ext == ".go" && !isGo2[name] {
-			f, err := parser.ParseFile(fset, fullPath, nil, 0)
-			if err != nil {
-				return nil, err
-			}
-
-			// get package name from *ast.File
-			if f.Name == nil {
-				return nil, errors.New("missing package declaration")
-			}
-			if pkgName == "" {
-				pkgName = f.Name.Name
-			} else if pkgName != f.Name.Name {
-				return nil, errors.New("mismatched package declarations")
-			}
-
-			goFiles = append(goFiles, f)
-			continue
-		}
-
 		b, err := ioutil.ReadFile(fullPath)
 		if err != nil {
 			return nil, err
 		}
 
-		src, cm, hm, err := process(string(b))
-		if err != nil {
-			return nil, err
+		// skip generated files: those of the .go2 files are replaced, and
+		// the orphans, whose .go2 file is gone, are removed
+		if ext == ".go" && isGenerated(b) {
+			continue
 		}
 
-		f, err := parser.ParseFile(fset, "", src, 0)
-		if err != nil {
-			return nil, err
-		}
-		// get package name from *ast.File
-		if f.Name == nil {
-			return nil, errors.New("missing package declaration")
+		// if the header can't be read, the parser reports why
+		if match, err := matchFile(ctxt, dirPath, file); err == nil && !match {
+			if ext == extension {
+				excluded = append(excluded, name)
+			}
+			continue
 		}
-		if pkgName == "" {
-			pkgName = f.Name.Name
-		} else if pkgName != f.Name.Name {
-			return nil, errors.New("mismatched package declarations")
+
+		if ext == ".go" {
+
+			f, err := parser.ParseFile(fset, fullPath, b, 0)
+			if err != nil {
+				diags = append(diags, parseDiagnostics(err)...)
+				continue
+			}
+			parsed = append(parsed, parsedFile{name: name, f: f})
+			continue
 		}
 
-		go2Files = append(go2Files, &go2File{
+		f, err := go2parser.ParseFile(fset, fullPath, b, parser.ParseComments)
+		if err != nil {
+			diags = append(diags, parseDiagnostics(err)...)
+			continue
+		}
+		gf := &go2File{
 			name:      name,
 			fset:      fset,
 			f:         f,
-			checkMap:  cm,
-			handleMap: hm,
-		})
+			path:      fullPath,
+			origins:   make(map[ast.Node]origin),
+			synthetic: make(map[ast.Node]bool),
+		}
+		gf.checks, gf.handles = lower(f)
+		parsed = append(parsed, parsedFile{name: name, f: f, gf: gf})
+	}
+
+	// the package is named by its first file, unless all of them
+	// could belong to an external test package
+	pkgName := ""
+	for _, pf := range parsed {
+		if pkgName == "" || !pf.isXTest() {
+			pkgName = pf.f.Name.Name
+		}
+		if !pf.isXTest() {
+			break
+		}
 	}
 
-	return &go2Package{
+	p := &go2Package{
 		name:     pkgName,
+		dir:      dirPath,
 		fset:     fset,
-		goFiles:  goFiles,
-		go2Files: go2Files,
-	}, nil
+		excluded: excluded,
+	}
+	xtest := &go2Package{
+		name: pkgName + "_test",
+		dir:  dirPath,
+		fset: fset,
+	}
+	for _, pf := range parsed {
+		q := p
+		switch {
+		case pf.f.Name.Name == pkgName:
+		case pf.f.Name.Name == xtest.name && pf.isXTest():
+			q = xtest
+		default:
+			pos := fset.Position(pf.f.Name.Pos())
+			msg := fmt.Sprintf("mismatched package declarations: %s and %s", pkgName, pf.f.Name.Name)
+			diags = append(diags, newDiagnostic(pos, codeParse, msg))
+			continue
+		}
+		if pf.gf != nil {
+			q.go2Files = append(q.go2Files, pf.gf)
+		} else {
+			q.goFiles = append(q.goFiles, pf.f)
+		}
+	}
+
+	if len(diags) > 0 {
+		return nil, diags
+	}
+
+	path, err := importPath(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	p.path = path
+	// the external tests share the importer, so that the packages
+	// imported by both are the same
+	paths := importPaths(path, p.files(), xtest.files())
+	p.imports = newPackagesImporter(dirPath, fset, paths)
+	p.importer = p.imports
+	if len(xtest.goFiles) > 0 || len(xtest.go2Files) > 0 {
+		// the external tests import the package under test
+		xtest.imports = p.imports
+		xtest.importer = &pkgImporter{p.importer, p}
+		xtest.path = path + "_test"
+		p.xtest = xtest
+	}
+	return p, nil
 }
 
-func (p *go2Package) checkTypes(errFn func(error)) (*types.Info, error) {
+// isGenerated reports whether src starts with go2gen's generated comment.
+func isGenerated(src []byte) bool {
+	return bytes.HasPrefix(src, []byte(generatedComment+"\n"))
+}
+
+// hasGeneratedHeader reports whether the file at path starts with
+// go2gen's generated comment, as isGenerated does, reading only as much
+// of it as that takes.
+func hasGeneratedHeader(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	b := make([]byte, len(generatedComment)+1)
+	_, err = io.ReadFull(f, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return isGenerated(b), nil
+}
+
+// importDiagnostics reports the imports of p that can't be loaded.
+// Without them, the checks using an import would just remain untyped.
+func (p *go2Package) importDiagnostics() diagnostics {
+	var diags diagnostics
+	for _, f := range p.files() {
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			// the package under test, "C" and "unsafe" aren't loaded
+			if err := p.imports.err(path); err != nil {
+				msg := fmt.Sprintf("can't import %s: %v", spec.Path.Value, err)
+				diags = append(diags, newDiagnostic(p.position(spec.Path.Pos()), codeImport, msg))
+			}
+		}
+	}
+	sortDiagnostics(diags)
+	return diags
+}
+
+// files returns the syntax trees of the files of p.
+func (p *go2Package) files() []*ast.File {
 	var files []*ast.File
 	files = append(files, p.goFiles...)
 	for _, gf := range p.go2Files {
 		files = append(files, gf.f)
 	}
+	return files
+}
+
+// checkTypes type-checks the files of p, along with the extra files.
+func (p *go2Package) checkTypes(errFn func(error), extra ...*ast.File) (*types.Info, error) {
+	files := append(p.files(), extra...)
 	cfg := &types.Config{
 		Error:    errFn,
-		Importer: importer.Default(),
+		Importer: p.importer,
+		// cgo isn't run, so the declarations in import "C" are unknown
+		FakeImportC: true,
 	}
 	info := &types.Info{
 		Types:      make(map[ast.Expr]types.TypeAndValue),
@@ -144,10 +308,51 @@ func (p *go2Package) checkTypes(errFn func(error)) (*types.Info, error) {
 		Selections: make(map[*ast.SelectorExpr]*types.Selection),
 		Scopes:     make(map[ast.Node]*types.Scope),
 	}
-	cfg.Check(p.name, p.fset, files, info)
+	pkgPath := p.path
+	if pkgPath == "" {
+		pkgPath = p.name
+	}
+	p.types, _ = cfg.Check(pkgPath, p.fset, files, info)
 	return info, nil
 }
 
 func parseString(s string) (ast.Node, error) {
 	return parser.ParseFile(token.NewFileSet(), "", s, 0)
 }
+
+// lower replaces the check expressions and handle statements of f with
+// their operands and blocks, leaving a tree that go/types can check, and
+// returns the operands and blocks, the latter with their error variables.
+func lower(f *ast.File) (map[ast.Expr]bool, map[*ast.BlockStmt]string) {
+	checks := make(map[ast.Expr]bool)
+	handles := make(map[*ast.BlockStmt]string)
+
+	// astutil.Apply can't walk the go2 nodes either,
+	// so their children are lowered before them
+	var pre func(c *astutil.Cursor) bool
+	var lowerNode func(node ast.Node) ast.Node
+	lowerNode = func(node ast.Node) ast.Node {
+		switch n := node.(type) {
+		case *go2parser.CheckExpr:
+			x := lowerNode(n.X).(ast.Expr)
+			checks[x] = true
+			return x
+		case *go2parser.HandleStmt:
+			astutil.Apply(n.Body, pre, nil)
+			handles[n.Body] = n.Err.Name
+			return n.Body
+		}
+		astutil.Apply(node, pre, nil)
+		return node
+	}
+	pre = func(c *astutil.Cursor) bool {
+		switch c.Node().(type) {
+		case *go2parser.CheckExpr, *go2parser.HandleStmt:
+			c.Replace(lowerNode(c.Node()))
+			return false
+		}
+		return true
+	}
+	lowerNode(f)
+	return checks, handles
+}
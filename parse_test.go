@@ -0,0 +1,100 @@
+package main
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/joelterry/fun"
+)
+
+func TestParsePkgConstraints(t *testing.T) {
+	other := "windows"
+	if build.Default.GOOS == other {
+		other = "linux"
+	}
+	dir := tempPkg(t, map[string]string{
+		"a.go2":                            "//go:build foo\n\npackage x\n\nconst A = 1\n",
+		"a_other.go":                       "//go:build !foo\n\npackage x\n\nconst A = 2\n",
+		"b_" + other + ".go2":              "package x\n\nconst B = 1\n",
+		"c.go2":                            "//go:build ignore\n\npackage main\n",
+		"d_" + build.Default.GOOS + ".go2": "package x\n\nconst D = 1\n",
+	})
+	defer os.RemoveAll(dir)
+
+	defer func(tags string) { *buildTags = tags }(*buildTags)
+
+	tests := []struct {
+		tags string
+		want []string
+	}{
+		{"", []string{"a_other.go", "d_" + build.Default.GOOS + ".go2"}},
+		{"bar,foo", []string{"a.go2", "d_" + build.Default.GOOS + ".go2"}},
+	}
+	for _, tt := range tests {
+		*buildTags = tt.tags
+		p, err := parsePkg(dir)
+		if err != nil {
+			t.Errorf("-tags %q: %v", tt.tags, err)
+			continue
+		}
+		var got []string
+		for _, f := range p.goFiles {
+			got = append(got, filepath.Base(p.fset.File(f.Pos()).Name()))
+		}
+		for _, gf := range p.go2Files {
+			got = append(got, filepath.Base(gf.path))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-tags %q: got files %v, want %v", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestParsePkgXTest(t *testing.T) {
+	dir := tempPkg(t, map[string]string{
+		"go.mod":       "module example.com/foo\n",
+		"foo.go2":      "package foo\n\nimport \"strconv\"\n\ntype Value int\n\nfunc Get(s string) (Value, error) {\n\tn := check strconv.Atoi(s)\n\treturn Value(n), nil\n}\n",
+		"foo_test.go2": "package foo_test\n\nimport \"example.com/foo\"\n\nfunc get() error {\n\tv := check foo.Get(\"1\")\n\t_ = v\n\treturn nil\n}\n",
+		"bar_test.go":  "package foo\n",
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := parsePkg(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.path != "example.com/foo" || len(p.go2Files) != 1 || len(p.goFiles) != 1 {
+		t.Fatalf("got package %s with %d .go2 and %d .go files, want example.com/foo with 1 and 1", p.path, len(p.go2Files), len(p.goFiles))
+	}
+	if p.xtest == nil || p.xtest.name != "foo_test" || len(p.xtest.go2Files) != 1 {
+		t.Fatalf("got external test package %+v, want foo_test with 1 .go2 file", p.xtest)
+	}
+
+	files, err := transpile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if filepath.Base(f.path) != "foo_test.go" {
+			continue
+		}
+		if !strings.Contains(string(f.data), "_go2Value0, _go2error0 := foo.Get(\"1\")") {
+			t.Errorf("the check in foo_test.go2 wasn't typed:\n%s", f.data)
+		}
+		return
+	}
+	t.Error("no foo_test.go was generated")
+}
+
+func TestModulePath(t *testing.T) {
+	f := fun.Test(t, modulePath)
+	f.In([]byte("module example.com/foo\n")).Out("example.com/foo")
+	f.In([]byte("// comment\nmodule \"example.com/foo\" // quoted\n\ngo 1.16\n")).Out("example.com/foo")
+	f.In([]byte("go 1.16\n")).Out("")
+}
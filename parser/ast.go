@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// A CheckExpr node represents a check expression: check X.
+//
+// The embedded BadExpr spans the expression, and only serves to make
+// CheckExpr an ast.Expr. Functions of go/ast and go/types don't know
+// about CheckExpr: use Inspect to traverse a tree containing one.
+type CheckExpr struct {
+	*ast.BadExpr
+	Check token.Pos // position of "check"
+	X     ast.Expr  // operand
+}
+
+func (x *CheckExpr) Pos() token.Pos { return x.Check }
+func (x *CheckExpr) End() token.Pos { return x.X.End() }
+
+// A HandleStmt node represents a handle statement: handle Err Body.
+//
+// Like CheckExpr, it embeds a BadStmt spanning the statement.
+type HandleStmt struct {
+	*ast.BadStmt
+	Handle token.Pos      // position of "handle"
+	Err    *ast.Ident     // error variable
+	Body   *ast.BlockStmt // handler
+}
+
+func (s *HandleStmt) Pos() token.Pos { return s.Handle }
+func (s *HandleStmt) End() token.Pos { return s.Body.End() }
+
+// Inspect traverses the tree of node like ast.Inspect, including the
+// operands of check expressions and the parts of handle statements.
+func Inspect(node ast.Node, f func(ast.Node) bool) {
+	ast.Walk(inspector(f), node)
+}
+
+type inspector func(ast.Node) bool
+
+func (f inspector) Visit(node ast.Node) ast.Visitor {
+	// ast.Walk can't walk the children of the go2 nodes
+	switch n := node.(type) {
+	case *CheckExpr:
+		if f(n) {
+			ast.Walk(f, n.X)
+			f(nil)
+		}
+		return nil
+	case *HandleStmt:
+		if f(n) {
+			ast.Walk(f, n.Err)
+			ast.Walk(f, n.Body)
+			f(nil)
+		}
+		return nil
+	}
+	if f(node) {
+		return f
+	}
+	return nil
+}
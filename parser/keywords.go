@@ -0,0 +1,238 @@
+package parser
+
+import (
+	"go/scanner"
+	"go/token"
+)
+
+// checkKeyword is a check keyword at offset check,
+// whose operand starts at offset operand.
+type checkKeyword struct {
+	check, operand int
+}
+
+// handleKeyword is a handle keyword at offset handle, followed by the
+// error variable err at offset errOff and a block at offset lbrace,
+// which is -1 if there is no block.
+type handleKeyword struct {
+	handle int
+	err    string
+	errOff int
+	lbrace int
+}
+
+// scanned is a token of the .go2 source.
+type scanned struct {
+	pos token.Pos
+	tok token.Token
+	lit string
+}
+
+// nesting is what an open parenthesis, bracket or brace delimits.
+type nesting int
+
+const (
+	nestExpr       nesting = iota // blocks, calls, composite literals...
+	nestDecl                      // grouped declarations
+	nestFields                    // struct and interface bodies
+	nestParams                    // parameter and result lists
+	nestTypeParams                // type parameter lists
+)
+
+// scanKeywords finds the check and handle keywords of src, the source of
+// the file filename, and reports the handles that aren't followed by a
+// block. Scanning errors are left to the parser.
+//
+// check and handle are only keywords where the draft grammar puts them:
+// check at the start of a unary expression, and handle followed by an
+// identifier at the start of a statement. Anywhere else, such as in
+// v.check(), check := 1 or a struct field named handle, they remain
+// identifiers. A check followed by ( or [ without a space in between
+// is a call or an index, as gofmt would write it, and so is a check
+// among the names declared by a var, const, type or import spec.
+// Likewise, an operator that is also binary, like - or <-, only starts
+// the operand of a check if it is written apart from check and next to
+// what follows it: check -x is a check, and check - x or check-x is a
+// subtraction.
+func scanKeywords(filename string, src []byte) ([]checkKeyword, []handleKeyword, scanner.ErrorList) {
+	// https://golang.org/pkg/go/scanner/#Scanner.Scan
+	var sc scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile(filename, fset.Base(), len(src))
+	sc.Init(file, src, nil, 0)
+
+	var toks []scanned
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		toks = append(toks, scanned{pos, tok, lit})
+	}
+	at := func(i int) scanned {
+		if i < 0 || i >= len(toks) {
+			return scanned{pos: file.Pos(len(src)), tok: token.EOF}
+		}
+		return toks[i]
+	}
+
+	var checks []checkKeyword
+	var handles []handleKeyword
+	var errs scanner.ErrorList
+
+	var stack []nesting
+	closed := make([]nesting, len(toks)) // what the closing tokens close
+	names := false                       // in the names of a spec
+	closedAt := func(i int) nesting {
+		if i < 0 {
+			return nestExpr
+		}
+		return closed[i]
+	}
+	for i, t := range toks {
+		prev := at(i - 1)
+		if kind, ok := opening(t.tok, prev.tok, at(i-2).tok, closedAt(i-1), closedAt(i-2)); ok {
+			stack = append(stack, kind)
+		}
+		if t.tok == token.RPAREN || t.tok == token.RBRACK || t.tok == token.RBRACE {
+			if len(stack) > 0 {
+				closed[i] = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		}
+
+		in := nestExpr
+		if len(stack) > 0 {
+			in = stack[len(stack)-1]
+		}
+		switch {
+		case declaring(t.tok), t.tok == token.LPAREN && declaring(prev.tok),
+			t.tok == token.SEMICOLON && in == nestDecl:
+			names = true
+			continue
+		case t.tok != token.IDENT:
+			names = names && t.tok == token.COMMA
+			continue
+		}
+		next := at(i + 1)
+		switch t.lit {
+		case "check":
+			if names || (in != nestExpr && in != nestDecl) || !beforeOperand(prev.tok) || !startsOperand(next.tok) {
+				continue
+			}
+			adjacent := next.pos == t.pos+token.Pos(len(t.lit))
+			if adjacent && (next.tok == token.LPAREN || next.tok == token.LBRACK) {
+				continue
+			}
+			if binary(next.tok) && (adjacent || at(i+2).pos != next.pos+token.Pos(len(next.tok.String()))) {
+				continue
+			}
+			checks = append(checks, checkKeyword{check: file.Offset(t.pos), operand: file.Offset(next.pos)})
+		case "handle":
+			if in != nestExpr || !startsStmt(prev.tok) || next.tok != token.IDENT {
+				continue
+			}
+			h := handleKeyword{
+				handle: file.Offset(t.pos),
+				err:    next.lit,
+				errOff: file.Offset(next.pos),
+				lbrace: -1,
+			}
+			if block := at(i + 2); block.tok == token.LBRACE {
+				h.lbrace = file.Offset(block.pos)
+			} else {
+				errs.Add(fset.Position(block.pos), "handle "+next.lit+" must be followed by a block")
+			}
+			handles = append(handles, h)
+		}
+	}
+	return checks, handles, errs
+}
+
+// opening reports whether tok opens a parenthesis, bracket or brace, and
+// what it delimits, given the two tokens before it, and what they close
+// if they are closing tokens.
+func opening(tok, prev, prev2 token.Token, closed, closed2 nesting) (nesting, bool) {
+	switch tok {
+	case token.LBRACE:
+		if prev == token.STRUCT || prev == token.INTERFACE {
+			return nestFields, true
+		}
+		return nestExpr, true
+	case token.LPAREN:
+		switch {
+		case declaring(prev):
+			return nestDecl, true
+		case prev == token.FUNC,
+			prev == token.IDENT && prev2 == token.FUNC,                            // func f(
+			prev == token.IDENT && prev2 == token.RPAREN && closed2 == nestParams, // func (r T) m(
+			prev == token.RPAREN && closed == nestParams,                          // results
+			prev == token.RBRACK && closed == nestTypeParams:
+			return nestParams, true
+		}
+		return nestExpr, true
+	case token.LBRACK:
+		if prev == token.IDENT && (prev2 == token.FUNC || prev2 == token.TYPE) {
+			return nestTypeParams, true
+		}
+		return nestExpr, true
+	}
+	return 0, false
+}
+
+// declaring reports whether tok starts a declaration of names.
+func declaring(tok token.Token) bool {
+	switch tok {
+	case token.VAR, token.CONST, token.TYPE, token.IMPORT:
+		return true
+	}
+	return false
+}
+
+// beforeOperand reports whether a unary expression can follow tok.
+func beforeOperand(tok token.Token) bool {
+	switch {
+	case tok.IsLiteral(), // identifiers included
+		tok == token.RPAREN, tok == token.RBRACK, tok == token.RBRACE,
+		tok == token.PERIOD, tok == token.INC, tok == token.DEC:
+		return false
+	case tok.IsKeyword():
+		switch tok {
+		case token.RETURN, token.CASE, token.GO, token.DEFER,
+			token.IF, token.FOR, token.SWITCH, token.RANGE, token.SELECT:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// startsOperand reports whether tok can start a unary expression.
+func startsOperand(tok token.Token) bool {
+	switch tok {
+	case token.IDENT, token.INT, token.FLOAT, token.IMAG, token.CHAR, token.STRING,
+		token.LPAREN, token.LBRACK, token.FUNC, token.STRUCT, token.MAP, token.CHAN, token.INTERFACE,
+		token.MUL, token.AND, token.ARROW, token.NOT, token.XOR, token.SUB, token.ADD:
+		return true
+	}
+	return false
+}
+
+// binary reports whether tok, which may start a unary
+// expression, is also a binary operator.
+func binary(tok token.Token) bool {
+	switch tok {
+	case token.MUL, token.AND, token.ARROW, token.XOR, token.SUB, token.ADD:
+		return true
+	}
+	return false
+}
+
+// startsStmt reports whether a statement can follow tok.
+func startsStmt(tok token.Token) bool {
+	switch tok {
+	case token.EOF, token.LBRACE, token.SEMICOLON, token.COLON:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+// Package parser parses .go2 source files, which are Go source files
+// that may use the check and handle keywords of the Go 2 error handling
+// draft design, into syntax trees. The trees are those of go/ast, plus
+// CheckExpr and HandleStmt nodes, and all of their positions refer to
+// the .go2 source.
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"reflect"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// ParseFile parses the .go2 source of a single file, like the ParseFile
+// of go/parser, which it takes the mode of: src may be a string, a []byte
+// or an io.Reader, or nil to read the file filename. Syntax errors,
+// including misplaced check and handle keywords, are returned as a
+// scanner.ErrorList, along with the tree that could be parsed.
+func ParseFile(fset *token.FileSet, filename string, src interface{}, mode parser.Mode) (*ast.File, error) {
+	text, err := readSource(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	checks, handles, errs := scanKeywords(filename, text)
+
+	// The keywords are blanked out rather than cut, so the positions
+	// of the Go parser are those of the .go2 source.
+	blanked := append([]byte(nil), text...)
+	for _, c := range checks {
+		blank(blanked, c.check, len("check"))
+	}
+	for _, h := range handles {
+		blank(blanked, h.handle, len("handle"))
+		blank(blanked, h.errOff, len(h.err))
+	}
+
+	f, err := parser.ParseFile(fset, filename, blanked, mode)
+	if f == nil {
+		return nil, err
+	}
+	if err != nil {
+		list, ok := err.(scanner.ErrorList)
+		if !ok {
+			return f, err
+		}
+		errs = append(errs, list...)
+	}
+	if mode&(parser.PackageClauseOnly|parser.ImportsOnly) == 0 {
+		errs = append(errs, extend(fset.File(f.Package), f, checks, handles)...)
+	}
+	if len(errs) > 0 {
+		errs.Sort()
+		return f, errs
+	}
+	return f, nil
+}
+
+func readSource(filename string, src interface{}) ([]byte, error) {
+	switch s := src.(type) {
+	case nil:
+		return ioutil.ReadFile(filename)
+	case string:
+		return []byte(s), nil
+	case []byte:
+		return s, nil
+	case io.Reader:
+		return ioutil.ReadAll(s)
+	}
+	return nil, errors.New("invalid source")
+}
+
+func blank(b []byte, off, n int) {
+	copy(b[off:off+n], bytes.Repeat([]byte{' '}, n))
+}
+
+// extend replaces the operands of checks in f with check expressions, and
+// the blocks of handles with handle statements. tf is the file of f.
+func extend(tf *token.File, f *ast.File, checks []checkKeyword, handles []handleKeyword) scanner.ErrorList {
+	checkAt := make(map[token.Pos]checkKeyword)
+	for _, c := range checks {
+		checkAt[tf.Pos(c.operand)] = c
+	}
+	handleAt := make(map[token.Pos]handleKeyword)
+	for _, h := range handles {
+		if h.lbrace >= 0 {
+			handleAt[tf.Pos(h.lbrace)] = h
+		}
+	}
+
+	// The operand of a check is the outermost unary expression starting
+	// where it does: in check f() + 1, that's f(), not f() + 1 or f.
+	operands := make(map[ast.Expr]checkKeyword)
+	blocks := make(map[*ast.BlockStmt]handleKeyword)
+	ast.Inspect(f, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.BinaryExpr, *ast.KeyValueExpr:
+		case *ast.BlockStmt:
+			if h, ok := handleAt[n.Pos()]; ok {
+				blocks[n] = h
+				delete(handleAt, n.Pos())
+			}
+		case ast.Expr:
+			if c, ok := checkAt[n.Pos()]; ok {
+				operands[n] = c
+				delete(checkAt, n.Pos())
+			}
+		}
+		return true
+	})
+
+	// keywords whose operand or block wasn't parsed
+	var errs scanner.ErrorList
+	for _, c := range checkAt {
+		errs.Add(tf.Position(tf.Pos(c.check)), "check must be followed by an expression")
+	}
+	for _, h := range handleAt {
+		errs.Add(tf.Position(tf.Pos(h.handle)), "handle "+h.err+" must be followed by a block")
+	}
+
+	// the operands are replaced bottom-up, so that
+	// nested checks are replaced within them
+	astutil.Apply(f, nil, func(c *astutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.BlockStmt:
+			if h, ok := blocks[n]; ok {
+				pos := tf.Pos(h.handle)
+				if !holds(c, stmtType) {
+					errs.Add(tf.Position(pos), "handle "+h.err+" is not a statement")
+					break
+				}
+				c.Replace(&HandleStmt{
+					BadStmt: &ast.BadStmt{From: pos, To: n.End()},
+					Handle:  pos,
+					Err:     &ast.Ident{NamePos: tf.Pos(h.errOff), Name: h.err},
+					Body:    n,
+				})
+			}
+		case ast.Expr:
+			if k, ok := operands[n]; ok {
+				pos := tf.Pos(k.check)
+				if !holds(c, exprType) {
+					// such as an identifier being declared
+					errs.Add(tf.Position(pos), "check must be followed by an expression")
+					break
+				}
+				c.Replace(&CheckExpr{
+					BadExpr: &ast.BadExpr{From: pos, To: n.End()},
+					Check:   pos,
+					X:       n,
+				})
+			}
+		}
+		return true
+	})
+	return errs
+}
+
+var (
+	exprType = reflect.TypeOf((*ast.Expr)(nil)).Elem()
+	stmtType = reflect.TypeOf((*ast.Stmt)(nil)).Elem()
+)
+
+// holds reports whether the field of the node at c holds any node of the
+// interface type t, and not only some of them, like the *ast.Ident fields.
+func holds(c *astutil.Cursor, t reflect.Type) bool {
+	parent := reflect.TypeOf(c.Parent())
+	if parent == nil || parent.Kind() != reflect.Ptr || parent.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	field, ok := parent.Elem().FieldByName(c.Name())
+	if !ok {
+		return false
+	}
+	ft := field.Type
+	if c.Index() >= 0 {
+		ft = ft.Elem()
+	}
+	return ft == t
+}
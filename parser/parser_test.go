@@ -0,0 +1,204 @@
+package parser
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseNodes parses src, as the body of a function if it isn't a file,
+// and describes the go2 nodes of the tree in order, checking that their
+// positions are those of their keywords.
+func parseNodes(t *testing.T, src string) ([]string, error) {
+	t.Helper()
+	if !strings.HasPrefix(src, "package ") {
+		src = "package p\n\nfunc _() {\n" + src + "\n}\n"
+	}
+	fset := token.NewFileSet()
+	f, err := ParseFile(fset, "a.go2", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	text := func(n ast.Node) string {
+		return src[fset.Position(n.Pos()).Offset:fset.Position(n.End()).Offset]
+	}
+	var nodes []string
+	Inspect(f, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *CheckExpr:
+			if !strings.HasPrefix(text(n), "check") {
+				t.Errorf("%s: check expression at %q", src, text(n))
+			}
+			nodes = append(nodes, "check "+text(n.X))
+		case *HandleStmt:
+			if !strings.HasPrefix(text(n), "handle "+n.Err.Name) || !strings.HasPrefix(text(n.Err), n.Err.Name) {
+				t.Errorf("%s: handle statement at %q", src, text(n))
+			}
+			nodes = append(nodes, "handle "+n.Err.Name+" "+text(n.Body))
+		}
+		return true
+	})
+	return nodes, nil
+}
+
+func TestParseFile(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"check nil", []string{"check nil"}},
+		{"check add(1, 2)", []string{"check add(1, 2)"}},
+		{
+			"check add(check add(1, 1), check add(1, 1))",
+			[]string{"check add(check add(1, 1), check add(1, 1))", "check add(1, 1)", "check add(1, 1)"},
+		},
+		{
+			"x := check add(check add(1, 1), check add(1, 1))",
+			[]string{"check add(check add(1, 1), check add(1, 1))", "check add(1, 1)", "check add(1, 1)"},
+		},
+		{"handle errFoo { print(errFoo) \n\t os.Exit(1) \n }", []string{"handle errFoo { print(errFoo) \n\t os.Exit(1) \n }"}},
+		{
+			"check atoi(a) + check atoi(b) + check atoi(c)",
+			[]string{"check atoi(a)", "check atoi(b)", "check atoi(c)"},
+		},
+		{"check (f())", []string{"check (f())"}},
+		{"x := check -f()", []string{"check -f()"}},
+		{"return check f(check)", []string{"check f(check)"}},
+		{"handle err { check := err }", []string{"handle err { check := err }"}},
+		{"f(func() error {\n\tx := check g()\n})", []string{"check g()"}},
+		{"handle err { check f() }", []string{"handle err { check f() }", "check f()"}},
+		{"check x.f()[0]", []string{"check x.f()[0]"}},
+
+		// check and handle used as ordinary identifiers are left alone
+		{"v.check()", nil},
+		{"check := 1", nil},
+		{"check, err := f()", nil},
+		{"check(x)", nil},
+		{"check[int](x)", nil},
+		{"x := check", nil},
+		{"f(check)", nil},
+		{"return check", nil},
+		{"package p\n\nfunc check(handle int) (check bool) {}", nil},
+		{"package p\n\nfunc (r T) handle(err error) {}", nil},
+		{"package p\n\nfunc f[check any]() {}", nil},
+		{"package p\n\ntype check struct {\n\thandle int\n\tcheck func()\n}", nil},
+		{"package p\n\ntype T interface {\n\thandle(err error)\n}", nil},
+		{"var (\n\thandle err\n)", nil},
+		{"handle(x)", nil},
+		{"handle ()", nil},
+		{"handle = nil", nil},
+		{"x.handle = f", nil},
+		{"T{check: 1, handle: 2}", nil},
+		{"flag.Handle(x)", nil},
+		{"var check *check", nil},
+		{"goto check", nil},
+		{"y := check - 1", nil},
+		{"y := 3 * check * 4", nil},
+		{"y := check*2 + 1", nil},
+		{"y := a &^ check & x", nil},
+		{"check <- v", nil},
+		{"check<-v", nil},
+		{"x := check <-c", []string{"check <-c"}},
+		{"x := check *p", []string{"check *p"}},
+		{"x := 3 * check -f()", []string{"check -f()"}},
+		{"var (\n\tcheck int\n)", nil},
+		{"var a, check int", nil},
+		{"var (\n\ta, check *T\n\tx = check f()\n)", []string{"check f()"}},
+		{"package p\n\nimport (\n\tcheck \"fmt\"\n)", nil},
+		{"package p\n\ntype (\n\tcheck int\n)", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseNodes(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string // the first error
+	}{
+		{"package p\n\nfunc f() {\n\thandle err\n}\n", "a.go2:4:12: handle err must be followed by a block"},
+		{"package p\n\nfunc f() {\n\thandle err return err\n}\n", "a.go2:4:13: handle err must be followed by a block"},
+		{"package p\n\nfunc f() error {\n\tx := check f(,)\n}\n", "a.go2:4:15: expected operand, found ','"},
+		{"package p\n\nfunc f() error {\n\tcheck := check\n\tcheck f())\n}\n", "a.go2:5:11: expected statement, found ')'"},
+	}
+	for _, tt := range tests {
+		_, err := ParseFile(token.NewFileSet(), "a.go2", tt.src, 0)
+		list, ok := err.(scanner.ErrorList)
+		if !ok || len(list) == 0 {
+			t.Errorf("%q: got %v, want an error list", tt.src, err)
+			continue
+		}
+		if got := list[0].Error(); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExtend(t *testing.T) {
+	// keywords before nodes that can't be replaced by go2 nodes,
+	// which the scanner doesn't find, are errors rather than panics
+	src := "package p\n\nimport x \"fmt\"\n\nvar a, b int\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "a.go2", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checks []checkKeyword
+	for _, name := range []string{"x", `"fmt"`, "b"} {
+		checks = append(checks, checkKeyword{operand: strings.Index(src, name)})
+	}
+	if errs := extend(fset.File(f.Package), f, checks, nil); len(errs) != len(checks) {
+		t.Errorf("got %v, want %d errors", errs, len(checks))
+	}
+}
+
+func TestParseFileModes(t *testing.T) {
+	src := "package p\n\nimport \"os\"\n\nfunc f() error {\n\tcheck os.Remove(\"x\")\n}\n"
+	for _, mode := range []parser.Mode{parser.PackageClauseOnly, parser.ImportsOnly} {
+		f, err := ParseFile(token.NewFileSet(), "a.go2", src, mode)
+		if err != nil || f.Name.Name != "p" {
+			t.Errorf("mode %v: got %v, %v", mode, f, err)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	src := "package p\n\nfunc f() error {\n\thandle err { return err }\n\tcheck g(check h())\n}\n"
+	f, err := ParseFile(token.NewFileSet(), "a.go2", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ast.Inspect would panic on the go2 nodes; Inspect calls
+	// f(nil) after the children of every node, like it does
+	depth, idents := 0, 0
+	Inspect(f, func(node ast.Node) bool {
+		if node == nil {
+			depth--
+			return true
+		}
+		if _, ok := node.(*ast.Ident); ok {
+			idents++
+		}
+		depth++
+		return true
+	})
+	if depth != 0 {
+		t.Errorf("got depth %d after the traversal, want 0", depth)
+	}
+	// p, f, error, err, err, g, h
+	if idents != 7 {
+		t.Errorf("visited %d identifiers, want 7", idents)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const recursiveSuffix = "..."
+
+// expandPatterns resolves package patterns into a sorted list of directories.
+//
+// A plain pattern names a single directory, which is returned as is.
+// A pattern ending in "..." (such as "./..." or "foo/...") matches the
+// directory and all of its subdirectories that contain .go2 files, or
+// generated files, which are orphans if their .go2 files are gone.
+// Like the go tool, the walk skips testdata and vendor directories, as well
+// as directories whose names begin with "." or "_".
+func expandPatterns(patterns []string) ([]string, error) {
+	return expandDirs(patterns, hasGo2OrGeneratedFiles)
+}
+
+// expandDirs is like expandPatterns, but "..." patterns match the
+// directories for which match reports true.
+func expandDirs(patterns []string, match func(dir string) (bool, error)) ([]string, error) {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, pattern := range patterns {
+		if !strings.HasSuffix(pattern, recursiveSuffix) {
+			add(pattern)
+			continue
+		}
+
+		root := filepath.Clean(strings.TrimSuffix(pattern, recursiveSuffix))
+		err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if p != root && skipDir(info.Name()) {
+				return filepath.SkipDir
+			}
+			ok, err := match(p)
+			if err != nil {
+				return err
+			}
+			if ok {
+				add(p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// skipDir reports whether the go tool ignores a directory
+// with the given name when matching "..." patterns.
+func skipDir(name string) bool {
+	switch {
+	case name == "testdata", name == "vendor":
+		return true
+	case strings.HasPrefix(name, "."), strings.HasPrefix(name, "_"):
+		return true
+	default:
+		return false
+	}
+}
+
+func hasGo2OrGeneratedFiles(dir string) (bool, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	infos, err := d.Readdir(0)
+	d.Close()
+	if err != nil {
+		return false, err
+	}
+	for _, info := range infos {
+		if filepath.Ext(info.Name()) == extension {
+			return true, nil
+		}
+	}
+	for _, info := range infos {
+		if filepath.Ext(info.Name()) != ".go" || !info.Mode().IsRegular() {
+			continue
+		}
+		ok, err := hasGeneratedHeader(filepath.Join(dir, info.Name()))
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/joelterry/fun"
+)
+
+func TestExpandPatterns(t *testing.T) {
+	f := fun.Test(t, expandPatterns)
+	f.In([]string{"test/input"}).Out([]string{"test/input"})
+	f.In([]string{"test/input", "./test/input/"}).Out([]string{"test/input"})
+	// test/output only has generated files
+	f.In([]string{"test/..."}).Out([]string{"test/input", "test/output"})
+	f.In([]string{"./..."}).Out([]string{".", "test/input", "test/output"})
+	f.In([]string{"test/output/..."}).Out([]string{"test/output"})
+	f.In([]string{"parser/..."}).Out([]string(nil))
+	f.In([]string{"missing/..."}).Err()
+}
+
+func TestSkipDir(t *testing.T) {
+	f := fun.Test(t, skipDir)
+	f.In("testdata").Out(true)
+	f.In("vendor").Out(true)
+	f.In(".git").Out(true)
+	f.In("_old").Out(true)
+	f.In("input").Out(false)
+}
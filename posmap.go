@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// originKind describes what produced a piece of generated code.
+type originKind int
+
+const (
+	originSource         originKind = iota // carried over from the .go2 source
+	originCheck                            // generated for a check
+	originHandler                          // copied from a handler
+	originDefaultHandler                   // the default handler of a check
+)
+
+var originKindNames = [...]string{
+	originSource:         "source",
+	originCheck:          "check",
+	originHandler:        "handler",
+	originDefaultHandler: "default-handler",
+}
+
+func (k originKind) String() string {
+	return originKindNames[k]
+}
+
+func (k originKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *originKind) UnmarshalText(b []byte) error {
+	for i, name := range originKindNames {
+		if name == string(b) {
+			*k = originKind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown origin kind %q", b)
+}
+
+// origin records where an inserted node comes from.
+type origin struct {
+	pos  token.Pos
+	kind originKind
+}
+
+// A posMap translates positions in a generated .go file
+// back to the .go2 file it was generated from.
+type posMap struct {
+	goPath   string
+	go2Path  string
+	segments []segment // sorted by generated position
+}
+
+// segment maps the start of a node in the generated file to the .go2 source.
+type segment struct {
+	line, col int
+	orig      token.Position
+	kind      originKind
+
+	// exact is true if the node kept its .go2 position,
+	// so that offsets within it are preserved
+	exact bool
+}
+
+// srcNode is a node of a transformed file, and the .go2 source position
+// it stems from. Inserted nodes without a recorded origin inherit the
+// origin of their parent.
+type srcNode struct {
+	node  ast.Node
+	pos   token.Pos
+	kind  originKind
+	exact bool
+}
+
+func (gf go2File) srcNodes() []srcNode {
+	var nodes, stack []srcNode
+	ast.Inspect(gf.f, func(node ast.Node) bool {
+		if node == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		if isComment(node) {
+			return false
+		}
+		sn := srcNode{node: node}
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			sn.pos, sn.kind = parent.pos, parent.kind
+		}
+		if o, ok := gf.origins[node]; ok {
+			sn.pos, sn.kind = o.pos, o.kind
+		}
+		if node.Pos().IsValid() && !gf.synthetic[node] {
+			sn.pos, sn.exact = node.Pos(), true
+		}
+		stack = append(stack, sn)
+		nodes = append(nodes, sn)
+		return true
+	})
+	return nodes
+}
+
+// isComment reports whether node is a comment. Comments aren't mapped,
+// and the //line directives added by -line would throw off the walk.
+func isComment(node ast.Node) bool {
+	switch node.(type) {
+	case *ast.CommentGroup, *ast.Comment:
+		return true
+	}
+	return false
+}
+
+func preorder(root ast.Node) []ast.Node {
+	var nodes []ast.Node
+	ast.Inspect(root, func(node ast.Node) bool {
+		if isComment(node) {
+			return false
+		}
+		if node != nil {
+			nodes = append(nodes, node)
+		}
+		return true
+	})
+	return nodes
+}
+
+// buildPosMap maps the generated file data, which is gf printed after transform,
+// back to the .go2 source. It does so by walking the transformed tree and data's
+// syntax tree side by side; the mapping stops where they diverge.
+func buildPosMap(gf *go2File, path string, data []byte) (*posMap, error) {
+	fset := token.NewFileSet()
+	out, err := parser.ParseFile(fset, "", data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &posMap{goPath: path, go2Path: gf.path}
+	src := gf.srcNodes()
+	seen := make(map[token.Pos]bool)
+	for i, node := range preorder(out) {
+		if i >= len(src) || reflect.TypeOf(node) != reflect.TypeOf(src[i].node) {
+			break
+		}
+		if seen[node.Pos()] || !src[i].pos.IsValid() {
+			continue
+		}
+		seen[node.Pos()] = true
+		gen := fset.PositionFor(node.Pos(), false)
+		m.segments = append(m.segments, segment{
+			line:  gen.Line,
+			col:   gen.Column,
+			orig:  gf.fset.Position(src[i].pos),
+			kind:  src[i].kind,
+			exact: src[i].exact,
+		})
+	}
+
+	sort.SliceStable(m.segments, func(i, j int) bool {
+		a, b := m.segments[i], m.segments[j]
+		return a.line < b.line || (a.line == b.line && a.col < b.col)
+	})
+	return m, nil
+}
+
+// segmentAt returns the segment that line:col of the generated file falls in:
+// the last one starting at or before it. A col of 0 stands for the line
+// as a whole, which falls in the first segment starting on it, if any.
+func (m *posMap) segmentAt(line, col int) (segment, bool) {
+	if col == 0 {
+		i := sort.Search(len(m.segments), func(i int) bool {
+			return m.segments[i].line >= line
+		})
+		if i < len(m.segments) && m.segments[i].line == line {
+			return m.segments[i], true
+		}
+	}
+	i := sort.Search(len(m.segments), func(i int) bool {
+		s := m.segments[i]
+		return s.line > line || (s.line == line && s.col > col)
+	}) - 1
+	if i < 0 {
+		return segment{}, false
+	}
+	return m.segments[i], true
+}
+
+// lookup returns the .go2 position corresponding to line and col in the
+// generated file. A col of 0 stands for the line as a whole.
+func (m *posMap) lookup(line, col int) token.Position {
+	s, ok := m.segmentAt(line, col)
+	if !ok {
+		return token.Position{Filename: m.go2Path, Line: 1}
+	}
+	p := s.orig
+	switch {
+	case s.line == line && s.exact:
+		p.Column += col - s.col
+	case s.line != line && s.exact:
+		// a later line of a node that spans several lines
+		p.Line += line - s.line
+		p.Column = col
+	}
+	if col == 0 {
+		p.Column = 0
+	}
+	return p
+}
+
+// addLineDirectives inserts //line directives into the generated file data,
+// so that the compiler, the runtime and debuggers report positions in
+// the .go2 file named go2Name instead. Directives are only inserted where
+// the mapped line numbers diverge, and only before lines that start with
+// a node, since those can't be inside a multi-line string.
+//
+// The code generated for a check maps to the check. The statements of a
+// handler, though, map to their own lines in the handle block rather than
+// to the handle statement, so that a panic or a breakpoint in a handler
+// points at the statement it's in; the if running them is at the check.
+//
+// The package clause and the lines before it are left alone, since tools
+// such as vet take the position of the package clause to be the name of
+// the file, and reparse it; that also keeps the directives clear of the
+// build constraints. A directive for a node with a doc comment goes above
+// the comment, set apart by a blank line, since cgo takes a directive in
+// the comment above import "C" to be part of the preamble.
+func addLineDirectives(data []byte, m *posMap, go2Name string) []byte {
+	lines := strings.SplitAfter(string(data), "\n")
+	next := 0 // the .go2 line that the next line continues at, if known
+	inHeader := true
+
+	starts := make(map[int]int) // line -> column of its first segment
+	for _, s := range m.segments {
+		if _, ok := starts[s.line]; !ok {
+			starts[s.line] = s.col
+		}
+	}
+
+	directives := make(map[int]int) // line -> .go2 line of the directive before it
+	for i, line := range lines {
+		n := i + 1
+		if inHeader {
+			inHeader = !strings.HasPrefix(line, "package ")
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if col, ok := starts[n]; ok && col == indent+1 {
+			orig := m.lookup(n, 0).Line
+			if orig != next {
+				directives[n] = orig
+			}
+			next = orig
+		}
+		if next > 0 {
+			next++
+		}
+	}
+
+	// blank lines to insert after the directive before a line
+	blank := make(map[int]bool)
+	docs := docComments(data)
+	for n, orig := range directives {
+		start, ok := docs[n-1]
+		if !ok {
+			continue
+		}
+		delete(directives, n)
+		// the directive names the line after it, which is blank
+		orig -= n - start + 1
+		if orig < 1 {
+			continue
+		}
+		if start > 1 && strings.TrimSpace(lines[start-2]) == "" {
+			directives[start-1] = orig
+		} else {
+			directives[start] = orig
+			blank[start] = true
+		}
+	}
+
+	var sb strings.Builder
+	for i, line := range lines {
+		if orig, ok := directives[i+1]; ok {
+			fmt.Fprintf(&sb, "//line %s:%d\n", go2Name, orig)
+			if blank[i+1] {
+				sb.WriteString("\n")
+			}
+		}
+		sb.WriteString(line)
+	}
+	return []byte(sb.String())
+}
+
+// docComments returns the comment groups in the Go source data that start
+// their first line, as a map from their last line to their first line.
+func docComments(data []byte) map[int]int {
+	docs := make(map[int]int)
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", data, parser.ParseComments)
+	if err != nil {
+		return docs
+	}
+	tf := fset.File(f.Pos())
+	for _, cg := range f.Comments {
+		start := tf.Position(cg.Pos())
+		line := tf.LineStart(start.Line)
+		if strings.TrimSpace(string(data[tf.Offset(line):tf.Offset(cg.Pos())])) != "" {
+			continue // a comment following code
+		}
+		docs[tf.Line(cg.End())] = start.Line
+	}
+	return docs
+}
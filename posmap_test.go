@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"go/token"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPosMap(t *testing.T) {
+	files, err := transpile(testInputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pm *posMap
+	for _, f := range files {
+		if path.Base(f.path) == "testfoo.go" {
+			pm = f.pos
+		}
+	}
+	if pm == nil {
+		t.Fatal("no position map for testfoo.go")
+	}
+
+	tests := []struct {
+		line, col       int // in testfoo.go
+		go2Line, go2Col int // in testfoo.go2
+	}{
+		{16, 1, 14, 1},   // func Foo
+		{22, 0, 23, 0},   // generated assignment: the check
+		{22, 27, 23, 14}, // the check operand, Foo(tc.a)
+		{23, 0, 23, 0},   // generated if: the check
+		{24, 0, 21, 0},   // copied handler
+		{26, 3, 23, 3},   // x := _go2int0
+		{26, 8, 23, 14},  // _go2int0: the check operand
+		{32, 6, 25, 6},   // x != y
+	}
+	for _, tt := range tests {
+		p := pm.lookup(tt.line, tt.col)
+		if path.Base(p.Filename) != "testfoo.go2" || p.Line != tt.go2Line || p.Column != tt.go2Col {
+			t.Errorf("lookup(%d, %d) = %v, want testfoo.go2:%d:%d", tt.line, tt.col, p, tt.go2Line, tt.go2Col)
+		}
+	}
+}
+
+func TestTranslator(t *testing.T) {
+	tr := newTranslator()
+	tr.add("foo.go", &posMap{
+		go2Path: "foo.go2",
+		segments: []segment{
+			{line: 3, col: 1, orig: position("foo.go2", 3, 1), exact: true},
+			{line: 5, col: 2, orig: position("foo.go2", 4, 8)},
+		},
+	})
+
+	tests := []struct{ in, out string }{
+		{"./foo.go:3:6: undefined: x\n", "foo.go2:3:6: undefined: x\n"},
+		{"foo.go:5:2: declared and not used\n", "foo.go2:4:8: declared and not used\n"},
+		{"\tfoo.go:5 +0x1d\n", "\tfoo.go2:4 +0x1d\n"},
+		{"bar.go:3:1: untouched\n", "bar.go:3:1: untouched\n"},
+	}
+	for _, tt := range tests {
+		if got := tr.line(tt.in); got != tt.out {
+			t.Errorf("line(%q) = %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
+
+func position(filename string, line, col int) token.Position {
+	return token.Position{Filename: filename, Line: line, Column: col}
+}
+
+func TestAddLineDirectives(t *testing.T) {
+	data := "package p\n\nfunc f() {\n\tx()\n\ty()\n}\n"
+	pm := &posMap{
+		go2Path: "dir/foo.go2",
+		segments: []segment{
+			{line: 1, col: 1, orig: position("dir/foo.go2", 1, 1), exact: true},
+			{line: 3, col: 1, orig: position("dir/foo.go2", 5, 1), exact: true},
+			{line: 4, col: 2, orig: position("dir/foo.go2", 6, 2), exact: true},
+			{line: 5, col: 2, orig: position("dir/foo.go2", 9, 2)},
+		},
+	}
+	want := "package p\n\n//line foo.go2:5\nfunc f() {\n\tx()\n//line foo.go2:9\n\ty()\n}\n"
+	got := string(addLineDirectives([]byte(data), pm, "foo.go2"))
+	if got != want {
+		t.Errorf("addLineDirectives:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLineDirectivesHandler(t *testing.T) {
+	defer func(on bool) { *lineDirectives = on }(*lineDirectives)
+	*lineDirectives = true
+
+	src := "package a\n\nfunc g() error { return nil }\n\nfunc f() error {\n\thandle err {\n\t\tprintln(\"failed\")\n\t\treturn err\n\t}\n\tcheck g()\n\treturn nil\n}\n"
+	dir := tempPkg(t, map[string]string{"a.go2": src})
+	defer os.RemoveAll(dir)
+
+	files, err := transpile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the generated if maps to the check, and the handler
+	// copied into it to the handler's own lines
+	want := "//line a.go2:10\n\tif _go2error0 != nil {\n//line a.go2:7\n\t\tprintln(\"failed\")\n\t\treturn _go2error0\n\t}\n//line a.go2:11\n"
+	if got := string(files[0].data); !strings.Contains(got, want) {
+		t.Errorf("got:\n%s\nwant it to contain:\n%s", got, want)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	pm := &posMap{
+		goPath:  "dir/foo.go",
+		go2Path: "dir/foo.go2",
+		segments: []segment{
+			{line: 3, col: 1, orig: position("dir/foo.go2", 1, 1), exact: true},
+			{line: 3, col: 9, orig: position("dir/foo.go2", 1, 9), exact: true},
+			{line: 7, col: 2, orig: position("dir/foo.go2", 6, 8), kind: originCheck},
+			{line: 8, col: 3, orig: position("dir/foo.go2", 4, 15), kind: originHandler, exact: true},
+		},
+	}
+	b, err := encodeSourceMap(pm, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sm sourceMap
+	err = json.Unmarshal(b, &sm)
+	if err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, b)
+	}
+	if sm.Generated != "foo.go" || sm.Source != "foo.go2" {
+		t.Errorf("got generated %q, source %q", sm.Generated, sm.Source)
+	}
+	if r := sm.Mappings[0].Original; r.Column != 1 || r.EndColumn != 9 {
+		t.Errorf("got original range %+v of first mapping, want columns 1 to 9", r)
+	}
+
+	pm2, err := sm.posMap("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pm, pm2) {
+		t.Errorf("round trip: got %+v, want %+v", pm2, pm)
+	}
+
+	segs := pm.reverse(4, 0)
+	if len(segs) != 1 || segs[0].line != 8 || segs[0].kind != originHandler {
+		t.Errorf("reverse(4, 0) = %+v", segs)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const sourceMapVersion = 1
+
+// sourceMap is the JSON form of a posMap, written next to
+// each generated file as foo.go2.map with -map.
+type sourceMap struct {
+	Version   int       `json:"version"`
+	Generated string    `json:"generated"` // relative to the map file
+	Source    string    `json:"source"`    // relative to the map file
+	Mappings  []mapping `json:"mappings"`
+}
+
+// mapping maps a column range of the generated file to the .go2 source.
+type mapping struct {
+	Generated mapRange   `json:"generated"`
+	Original  mapRange   `json:"original"`
+	Kind      originKind `json:"kind"`
+
+	// Exact is true if the code was carried over verbatim,
+	// so that columns within the range correspond.
+	Exact bool `json:"exact,omitempty"`
+}
+
+// mapRange is a range of columns on a line.
+// An EndColumn of 0 means the range extends to the end of the line,
+// or, for original ranges, that the length is unknown.
+type mapRange struct {
+	Line      int `json:"line"`
+	Column    int `json:"column"`
+	EndColumn int `json:"endColumn,omitempty"`
+}
+
+func mapFileName(go2Path string) string {
+	return go2Path + ".map"
+}
+
+// sourceMap converts m into its JSON form, for a map file in dir.
+func (m *posMap) sourceMap(dir string) (*sourceMap, error) {
+	gen, err := relPath(dir, m.goPath)
+	if err != nil {
+		return nil, err
+	}
+	src, err := relPath(dir, m.go2Path)
+	if err != nil {
+		return nil, err
+	}
+	sm := &sourceMap{
+		Version:   sourceMapVersion,
+		Generated: filepath.ToSlash(gen),
+		Source:    filepath.ToSlash(src),
+	}
+	for i, s := range m.segments {
+		mp := mapping{
+			Generated: mapRange{Line: s.line, Column: s.col},
+			Original:  mapRange{Line: s.orig.Line, Column: s.orig.Column},
+			Kind:      s.kind,
+			Exact:     s.exact,
+		}
+		if i+1 < len(m.segments) && m.segments[i+1].line == s.line {
+			mp.Generated.EndColumn = m.segments[i+1].col
+			if s.exact {
+				mp.Original.EndColumn = s.orig.Column + mp.Generated.EndColumn - s.col
+			}
+		}
+		sm.Mappings = append(sm.Mappings, mp)
+	}
+	return sm, nil
+}
+
+// posMap converts sm, read from a map file in dir, back into a posMap.
+func (sm *sourceMap) posMap(dir string) (*posMap, error) {
+	if sm.Version != sourceMapVersion {
+		return nil, fmt.Errorf("unsupported source map version %d", sm.Version)
+	}
+	m := &posMap{
+		goPath:  filepath.Join(dir, filepath.FromSlash(sm.Generated)),
+		go2Path: filepath.Join(dir, filepath.FromSlash(sm.Source)),
+	}
+	for _, mp := range sm.Mappings {
+		m.segments = append(m.segments, segment{
+			line: mp.Generated.Line,
+			col:  mp.Generated.Column,
+			orig: token.Position{
+				Filename: m.go2Path,
+				Line:     mp.Original.Line,
+				Column:   mp.Original.Column,
+			},
+			kind:  mp.Kind,
+			exact: mp.Exact,
+		})
+	}
+	return m, nil
+}
+
+// encodeSourceMap returns the map file for m in dir. It is indented like
+// json.MarshalIndent would, except that each mapping is kept on one line.
+func encodeSourceMap(m *posMap, dir string) ([]byte, error) {
+	sm, err := m.sourceMap(dir)
+	if err != nil {
+		return nil, err
+	}
+	mappings := sm.Mappings
+	sm.Mappings = nil
+	b, err := json.MarshalIndent(sm, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(b[:bytes.LastIndex(b, []byte("null"))])
+	buf.WriteString("[")
+	for i, mp := range mappings {
+		line, err := json.Marshal(mp)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n\t\t")
+		buf.Write(line)
+	}
+	if len(mappings) > 0 {
+		buf.WriteString("\n\t")
+	}
+	buf.WriteString("]\n}\n")
+	return buf.Bytes(), nil
+}
+
+func readSourceMap(path string) (*posMap, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sm sourceMap
+	err = json.Unmarshal(b, &sm)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sm.posMap(filepath.Dir(path))
+}
+
+// reverse returns the segments of the generated file that stem from
+// line:col of the .go2 file, at most one per generated line. A col of 0
+// stands for the line as a whole.
+func (m *posMap) reverse(line, col int) []segment {
+	var matches []segment
+	for _, s := range m.segments {
+		if s.orig.Line == line && (col == 0 || s.orig.Column == col) {
+			matches = append(matches, s)
+		}
+	}
+	if len(matches) == 0 && col != 0 {
+		return m.reverse(line, 0)
+	}
+
+	var segs []segment
+	for i, s := range matches {
+		if i == 0 || s.line != matches[i-1].line {
+			segs = append(segs, s)
+		}
+	}
+	sort.SliceStable(segs, func(i, j int) bool {
+		return segs[i].line < segs[j].line
+	})
+	return segs
+}
+
+var posArg = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?$`)
+
+// findPosMap returns the map of the generated file path, or of the
+// file generated from the .go2 file path. It reads the map file if
+// there is one, and transpiles the package in memory otherwise.
+func findPosMap(path string) (*posMap, error) {
+	dir := filepath.Dir(path)
+	go2Path := path
+	if !strings.HasSuffix(path, extension) {
+		name, ok := go2FileName(filepath.Base(path))
+		if !ok {
+			return nil, fmt.Errorf("%s: not named like a generated file", path)
+		}
+		go2Path = filepath.Join(dir, name+extension)
+	}
+
+	dst, err := outputDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, extension) {
+		// the generated file is already in the output directory
+		dst = dir
+	}
+	m, err := readSourceMap(filepath.Join(dst, mapFileName(filepath.Base(go2Path))))
+	if err == nil {
+		return m, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	files, err := transpile(filepath.Dir(go2Path))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.pos != nil && filepath.Clean(f.pos.go2Path) == filepath.Clean(go2Path) {
+			return f.pos, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no .go2 source found", path)
+}
+
+// queryMap prints the .go2 position corresponding to a FILE.go:LINE[:COL]
+// argument, or the generated positions corresponding to FILE.go2:LINE[:COL].
+func queryMap(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: go2gen map FILE:LINE[:COL]")
+	}
+	for _, arg := range args {
+		sub := posArg.FindStringSubmatch(arg)
+		if sub == nil {
+			return fmt.Errorf("%s: expected FILE:LINE or FILE:LINE:COL", arg)
+		}
+		path := sub[1]
+		line, _ := strconv.Atoi(sub[2])
+		col := 0
+		if sub[3] != "" {
+			col, _ = strconv.Atoi(sub[3])
+		}
+
+		m, err := findPosMap(path)
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasSuffix(path, extension) {
+			s, _ := m.segmentAt(line, col)
+			fmt.Printf("%s (%s)\n", formatPos(m.lookup(line, col)), s.kind)
+			continue
+		}
+
+		segs := m.reverse(line, col)
+		if len(segs) == 0 {
+			return fmt.Errorf("%s: no generated code", arg)
+		}
+		for _, s := range segs {
+			p := token.Position{Filename: m.goPath, Line: s.line, Column: s.col}
+			fmt.Printf("%s (%s)\n", formatPos(p), s.kind)
+		}
+	}
+	return nil
+}
+
+func formatPos(p token.Position) string {
+	s := p.Filename + ":" + strconv.Itoa(p.Line)
+	if p.Column > 0 {
+		s += ":" + strconv.Itoa(p.Column)
+	}
+	return s
+}
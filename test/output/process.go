@@ -24,16 +24,16 @@ func moreWrapping(e error) error {
 
 func process(user string, files chan string) (n int, err error) {
 	for i := 0; i < 3; i++ {
-		_go2error0 := do(something())
+		_go2error0 := do(something()) // check 1: handler chain C, B, A
 		if _go2error0 != nil {
 			_go2error0 = moreWrapping(_go2error0)
 			_go2error0 = fmt.Errorf("attempt %d: %v", i, _go2error0)
 			return 0, fmt.Errorf("process: %v", _go2error0)
 		}
 	}
-	_go2error0 := do(somethingElse())
+	_go2error0 := do(somethingElse()) // check 2: handler chain A
 	if _go2error0 != nil {
 		return 0, fmt.Errorf("process: %v", _go2error0)
 	}
-	return
+	return // NOTE: not in example, I assume it's an error
 }
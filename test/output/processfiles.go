@@ -31,7 +31,7 @@ func (e *Error) Error() string {
 
 func ProcessFiles(user string, files chan string) error {
 	e := Error{Func: "ProcessFile", User: user}
-	_go2User0, _go2error0 := OpenUserInfo(user)
+	_go2User0, _go2error0 := OpenUserInfo(user) // check 1
 	if _go2error0 != nil {
 		e.Err = _go2error0
 		return &e
@@ -39,18 +39,19 @@ func ProcessFiles(user string, files chan string) error {
 	u := _go2User0
 	defer u.Close()
 	for file := range files {
-		_go2ptrFile0, _go2error0 := os.Open(file)
-		if _go2error0 != nil {
+		_go2ptrFile0, _go2error1 := os.Open(file) // check 2
+		if _go2error1 != nil {
 			e.Path = file
-			e.Err = _go2error0
+			e.Err = _go2error1
 			return &e
 		}
-		_go2error1 := process2(_go2ptrFile0)
-		if _go2error1 != nil {
+		_go2error2 := process2(_go2ptrFile0)
+		if _go2error2 != nil {
 			e.Path = file
-			e.Err = _go2error1
+			e.Err = _go2error2
 			return &e
 		}
 	}
+	// ...
 	return nil
 }
@@ -13,7 +13,7 @@ import (
 func SortContents(w io.Writer, files []string) error {
 	lines := []string{}
 	for _, file := range files {
-		_go2ptrFile0, _go2error0 := os.Open(file)
+		_go2ptrFile0, _go2error0 := os.Open(file) // check runs B on error
 		if _go2error0 != nil {
 			return fmt.Errorf("read %s: %v ", file, _go2error0)
 		}
@@ -21,14 +21,14 @@ func SortContents(w io.Writer, files []string) error {
 		for scan.Scan() {
 			lines = append(lines, scan.Text())
 		}
-		_go2error1 := scan.Err()
+		_go2error1 := scan.Err() // check runs B on error
 		if _go2error1 != nil {
 			return fmt.Errorf("read %s: %v ", file, _go2error1)
 		}
 	}
 	sort.Strings(lines)
 	for _, line := range lines {
-		_, _go2error0 := io.WriteString(w, line)
+		_, _go2error0 := io.WriteString(w, line) // check runs A on error
 		if _go2error0 != nil {
 			return fmt.Errorf("process: %v", _go2error0)
 		}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"go/ast"
 	"go/format"
 	"go/token"
 	"go/types"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/go-toolsmith/astcopy"
 	"golang.org/x/tools/go/ast/astutil"
@@ -22,12 +23,129 @@ type go2File struct {
 	name string
 	fset *token.FileSet
 	f    *ast.File
-	checkMap
-	handleMap
+
+	// path is the path of the .go2 source, which the positions in f
+	// refer to.
+	path string
+
+	// origins records what produced the nodes inserted by transform.
+	origins map[ast.Node]origin
+
+	// synthetic holds the inserted nodes that were given a position
+	// by place; their positions don't refer to their own source.
+	synthetic map[ast.Node]bool
+
+	// checks holds the operands of the checks, and handles the blocks
+	// of the handles, with their error variables.
+	checks  map[ast.Expr]bool
+	handles map[*ast.BlockStmt]string
+}
+
+// diagnostic returns a diagnostic for node, which can't be transformed.
+func (gf go2File) diagnostic(node ast.Node, msg string) diagnostic {
+	return newDiagnostic(gf.fset.Position(node.Pos()), codeTransform, msg)
+}
+
+// dropComments removes the comments within node, those following it on
+// its last line, and the comment right above it, which is about it, since
+// node is removed; handlers are copied without their comments.
+func (gf go2File) dropComments(node ast.Node) {
+	tf := gf.fset.File(node.Pos())
+	endLine := tf.Line(node.End())
+	var groups []*ast.CommentGroup
+	for _, cg := range gf.f.Comments {
+		if tf.Line(cg.End()) == tf.Line(node.Pos())-1 && !gf.followsCode(cg) {
+			continue
+		}
+		var list []*ast.Comment
+		for _, c := range cg.List {
+			if c.Pos() < node.Pos() || (c.Pos() >= node.End() && tf.Line(c.Pos()) != endLine) {
+				list = append(list, c)
+			}
+		}
+		if len(list) > 0 {
+			cg.List = list
+			groups = append(groups, cg)
+		}
+	}
+	gf.f.Comments = groups
+}
+
+// followsCode reports whether cg starts on a line after some code,
+// which it's a comment on.
+func (gf go2File) followsCode(cg *ast.CommentGroup) bool {
+	tf := gf.fset.File(cg.Pos())
+	start := tf.LineStart(tf.Line(cg.Pos()))
+	found := false
+	ast.Inspect(gf.f, func(node ast.Node) bool {
+		if found || node == nil || isComment(node) {
+			return false
+		}
+		if node.End() > start && node.End() <= cg.Pos() {
+			found = true
+		}
+		return node.Pos() < cg.Pos()
+	})
+	return found
 }
 
-func (gf go2File) pos(node ast.Node) token.Pos {
-	return node.Pos() - gf.f.Pos() + 1
+// place gives the inserted nodes of the tree at node the position pos,
+// leaving nodes from the source, such as copied handlers, untouched.
+// The printer emits a pending comment as soon as it reaches a later
+// position, and it estimates the position of nodes without one, so this
+// keeps comments from ending up in the middle of generated code.
+func (gf go2File) place(node ast.Node, pos token.Pos) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		if n == nil || n.Pos().IsValid() {
+			return false
+		}
+		gf.synthetic[n] = true
+		switch n := n.(type) {
+		case *ast.Ident:
+			n.NamePos = pos
+		case *ast.AssignStmt:
+			n.TokPos = pos
+		case *ast.IfStmt:
+			n.If = pos
+		case *ast.BinaryExpr:
+			n.OpPos = pos
+		case *ast.BlockStmt:
+			n.Lbrace, n.Rbrace = pos, pos
+		case *ast.ReturnStmt:
+			n.Return = pos
+		case *ast.CallExpr:
+			n.Lparen, n.Rparen = pos, pos
+		}
+		return true
+	})
+}
+
+// lineEnd returns the position of the end of the line pos is on.
+func (gf go2File) lineEnd(pos token.Pos) token.Pos {
+	tf := gf.fset.File(pos)
+	line := tf.Line(pos)
+	if line < tf.LineCount() {
+		return tf.LineStart(line+1) - 1
+	}
+	return token.Pos(tf.Base() + tf.Size())
+}
+
+// generated records that node was inserted for the code at pos.
+func (gf go2File) generated(node ast.Node, pos token.Pos, kind originKind) {
+	gf.origins[node] = origin{pos: pos, kind: kind}
+}
+
+// unparsable returns a diagnostic for err, the error parsing the code
+// generated for gf, at the identifier that's invalid in it, if any, or
+// else at the file.
+func (gf go2File) unparsable(err error) diagnostics {
+	msg := fmt.Sprintf("internal error: the generated code doesn't parse: %v; please report this as a bug", err)
+	for _, sn := range gf.srcNodes() {
+		if id, ok := sn.node.(*ast.Ident); ok && !token.IsIdentifier(id.Name) && sn.pos.IsValid() {
+			return diagnostics{newDiagnostic(gf.fset.Position(sn.pos), codeInternal, msg)}
+		}
+	}
+	return diagnostics{{File: gf.path, Severity: severityError, Code: codeInternal, Message: msg}}
 }
 
 func (gf go2File) string() (string, error) {
@@ -39,7 +157,7 @@ func (gf go2File) string() (string, error) {
 	str := buf.String()
 	f, err := parseString(str)
 	if err != nil {
-		return "", err
+		return "", gf.unparsable(err)
 	}
 
 	funcPositions := make(map[token.Pos]token.Pos) // beginning -> end
@@ -216,47 +334,21 @@ func lexicalStmtTree(root ast.Node, info treeInfo) stmtTree {
 func collectChecksAndHandles(gf *go2File, handlerErrNames map[*ast.BlockStmt]string) []ast.Expr {
 
 	var checks []ast.Expr
-	checkCollected := make(map[token.Pos]bool)
 
 	astutil.Apply(gf.f, func(c *astutil.Cursor) bool {
-
-		node := c.Node()
-		if node == nil {
-			return true
-		}
-		pos := gf.pos(node)
-
-		if errName, ok := gf.handleMap[pos]; ok {
-			block, ok := node.(*ast.BlockStmt)
-			if !ok {
-				panic(fmt.Errorf("handle not a block: %#v", node))
+		switch node := c.Node().(type) {
+		case *ast.BlockStmt:
+			if errName, ok := gf.handles[node]; ok {
+				handlerErrNames[node] = errName
+				gf.dropComments(node)
+				c.Delete()
+				return false
 			}
-			handlerErrNames[block] = errName
-			c.Delete()
-			return false
-		}
-
-		if gf.checkMap[pos] {
-			expr, ok := node.(ast.Expr)
-			if !ok {
-				// should this be an error?
-				return true
-			}
-			// filter out non-unary expressions
-			switch expr.(type) {
-			case *ast.BinaryExpr, *ast.KeyValueExpr:
-				return true
-			}
-
-			// ensure we don't get duplicates for the same pos
-			// for example: check fn(), we only want fn(), not the identifier "fn" as well
-			if checkCollected[pos] {
-				return true
+		case ast.Expr:
+			if gf.checks[node] {
+				checks = append(checks, node)
 			}
-			checkCollected[pos] = true
-			checks = append(checks, expr)
 		}
-
 		return true
 	}, nil)
 
@@ -267,6 +359,18 @@ type transformContext struct {
 	checks          map[ast.Expr]checkInfo
 	toDelete        map[ast.Node]bool
 	handlerErrNames map[*ast.BlockStmt]string
+
+	// wrappers holds the calls standing in for the checks
+	// while the package is type-checked, by operand
+	wrappers map[ast.Expr]*checkWrapper
+
+	// temps holds the names of the variables declared
+	// for the checks, by the scope they are declared in
+	temps map[*types.Scope]map[string]bool
+
+	// at is the position of the check being transformed,
+	// for reporting internal errors
+	at *token.Pos
 }
 
 func newTransformContext() transformContext {
@@ -274,24 +378,24 @@ func newTransformContext() transformContext {
 		checks:          make(map[ast.Expr]checkInfo),
 		toDelete:        make(map[ast.Node]bool),
 		handlerErrNames: make(map[*ast.BlockStmt]string),
+		wrappers:        make(map[ast.Expr]*checkWrapper),
+		temps:           make(map[*types.Scope]map[string]bool),
+		at:              new(token.Pos),
 	}
 }
 
 func (tc transformContext) buildHandlerChains(gf *go2File, info treeInfo, st stmtTree, checks []ast.Expr) {
 
 	for _, c := range checks {
+		*tc.at = c.Pos()
 		var chain []*ast.BlockStmt
 
 		stmt := info.exprTree[c]
 		for stmt != nil {
-			pos := gf.pos(stmt)
-			_, ok := gf.handleMap[pos]
-			if ok {
-				block, ok := stmt.(*ast.BlockStmt)
-				if !ok {
-					panic(fmt.Errorf("handle not a block: %#v", stmt))
+			if block, ok := stmt.(*ast.BlockStmt); ok {
+				if _, ok := gf.handles[block]; ok {
+					chain = append(chain, block)
 				}
-				chain = append(chain, block)
 			}
 			stmt = st[stmt]
 		}
@@ -307,19 +411,20 @@ func (tc transformContext) buildHandlerChains(gf *go2File, info treeInfo, st stm
 	}
 }
 
-func (tc transformContext) consumeTypedChecks(gf *go2File, info *types.Info) {
+// consumeTypedChecks transforms the checks whose types are known,
+// and removes the wrappers of all of them.
+// Checks that turn out to be invalid are removed, and reported in the
+// returned diagnostics.
+func (tc transformContext) consumeTypedChecks(gf *go2File, info *types.Info) diagnostics {
 
 	stmtInterrupted := make(map[ast.Stmt]bool)
+	var diags diagnostics
 
 	astutil.Apply(gf.f, nil, func(c *astutil.Cursor) bool {
 
-		node := c.Node()
-		if node == nil {
-			return true
-		}
-
-		expr, ok := node.(ast.Expr)
-		if !ok {
+		// checks are reached through their wrappers, which are removed
+		expr := tc.unwrap(c)
+		if expr == nil {
 			return true
 		}
 
@@ -334,60 +439,81 @@ func (tc transformContext) consumeTypedChecks(gf *go2File, info *types.Info) {
 			return true
 		}
 
+		*tc.at = expr.Pos()
 		delete(tc.checks, expr)
 
+		invalid := func(format string, args ...interface{}) bool {
+			msg := fmt.Sprintf("invalid check %s: ", types.ExprString(expr)) + fmt.Sprintf(format, args...)
+			diags = append(diags, gf.diagnostic(expr, msg))
+			return true
+		}
+
 		var names []string
 
 		switch v := t.(type) {
-		case *types.Named:
-			names = []string{"error"}
 		case *types.Tuple:
+			if v.Len() == 0 {
+				return invalid("operand has no value")
+			}
+			last := v.At(v.Len() - 1).Type()
+			if !isError(last) {
+				return invalid("last value must be an error, not %s", last)
+			}
 			names = make([]string, v.Len())
-			for i := 0; i < v.Len(); i++ {
-				names[i] = typeToVar(v.At(i).Type().String())
+			for i := 0; i < v.Len()-1; i++ {
+				name, err := typeToVar(v.At(i).Type().String())
+				if err != nil {
+					return invalid("%v", err)
+				}
+				names[i] = name
 			}
+			names[v.Len()-1] = "error"
 		default:
-			panic(fmt.Errorf("return type must be Named or Tuple: %#v", v))
-		}
-
-		if len(names) == 0 {
-			panic(errors.New("check expression evaluates to no values"))
-		}
-
-		if names[len(names)-1] != "error" {
-			panic(errors.New("lats value of check expression must be error"))
+			if !isError(t) {
+				return invalid("operand of type %s isn't an error or a list of values ending in one", t)
+			}
+			names = []string{"error"}
 		}
 
 		for i, name := range names {
-			names[i] = varPrefix + name + strconv.Itoa(checkInfo.scope[name])
-			checkInfo.scope[name]++
+			names[i] = tc.tempName(info, checkInfo, name)
 		}
 
 		errName := names[len(names)-1]
 
+		// identifiers replacing the check expression
+		idents := func(ns []string) []ast.Expr {
+			exprs := toIdentExprs(ns)
+			for _, e := range exprs {
+				gf.generated(e, expr.Pos(), originCheck)
+				gf.place(e, expr.Pos())
+			}
+			return exprs
+		}
+
 		switch v := c.Parent().(type) {
 
 		// CallExpr, AssignStmt, ReturnStmt: potential tuples
 		case *ast.CallExpr:
 			if len(names) > 2 {
 				args := names[0 : len(names)-1]
-				v.Args = toIdentExprs(args)
+				v.Args = idents(args)
 			} else {
-				c.Replace(ast.NewIdent(names[0]))
+				c.Replace(idents(names[0:1])[0])
 			}
 		case *ast.AssignStmt:
 			if len(names) > 2 {
 				args := names[0 : len(names)-1]
-				v.Rhs = toIdentExprs(args)
+				v.Rhs = idents(args)
 			} else {
-				c.Replace(ast.NewIdent(names[0]))
+				c.Replace(idents(names[0:1])[0])
 			}
 		case *ast.ReturnStmt:
 			if len(names) > 2 {
 				args := names[0 : len(names)-1]
-				v.Results = toIdentExprs(args)
+				v.Results = idents(args)
 			} else {
-				c.Replace(ast.NewIdent(names[0]))
+				c.Replace(idents(names[0:1])[0])
 			}
 
 		case *ast.ExprStmt:
@@ -397,20 +523,32 @@ func (tc transformContext) consumeTypedChecks(gf *go2File, info *types.Info) {
 			}
 		case ast.Expr:
 			if len(names) < 2 {
-				panic(errors.New("check expression's parent must be call or assignment to have multiple values"))
+				return invalid("only an error is checked, so there's no value to use in an expression")
 			}
-			c.Replace(ast.NewIdent(names[0]))
+			c.Replace(idents(names[0:1])[0])
 		}
 
 		var hl []ast.Stmt
 		for _, handler := range checkInfo.handleChain {
 			h := astcopy.BlockStmt(handler)
 			replaceIdent(h, tc.handlerErrNames[handler], errName)
+			for _, stmt := range h.List {
+				gf.generated(stmt, stmt.Pos(), originHandler)
+			}
 			hl = append(hl, h.List...)
 		}
-		defaultHandler := defaultHandleStmt2(checkInfo.fun, info)
+		defaultHandler, err := defaultHandleStmt2(checkInfo.fun, info)
+		if err != nil {
+			var node ast.Node = expr
+			if ne, ok := err.(*nodeError); ok {
+				node = ne.node
+			}
+			diags = append(diags, gf.diagnostic(node, err.Error()))
+			return true
+		}
 		if defaultHandler != nil {
 			replaceIdent(defaultHandler, defaultHandlerErrName, errName)
+			gf.generated(defaultHandler, expr.Pos(), originDefaultHandler)
 			hl = append(hl, defaultHandler)
 		}
 		handleBody := &ast.BlockStmt{List: hl}
@@ -429,6 +567,11 @@ func (tc transformContext) consumeTypedChecks(gf *go2File, info *types.Info) {
 			},
 			Body: handleBody,
 		}
+		gf.generated(genAssign, expr.Pos(), originCheck)
+		gf.generated(genIf, expr.Pos(), originCheck)
+		// comments on the line of the check follow the assignment
+		gf.place(genAssign, expr.Pos())
+		gf.place(genIf, gf.lineEnd(expr.End()))
 
 		cb := checkInfo.block
 		for i, stmt := range cb.List {
@@ -449,6 +592,78 @@ func (tc transformContext) consumeTypedChecks(gf *go2File, info *types.Info) {
 
 		return true
 	})
+	return diags
+}
+
+// tempName returns the name of a variable of type typeName, declared in the
+// block of the check described by ci. The name is new to the scope of the
+// block and the scopes enclosing it, which include the variables declared
+// for earlier checks, and to the handlers of the check, so that it shadows
+// nothing that the handlers or the following statements use.
+func (tc transformContext) tempName(info *types.Info, ci checkInfo, typeName string) string {
+	scope := blockScope(info, ci)
+	var handlerNames map[string]bool
+	for {
+		name := varPrefix + typeName + strconv.Itoa(ci.scope[typeName])
+		ci.scope[typeName]++
+		if tc.inScope(scope, name) {
+			continue
+		}
+		if handlerNames == nil {
+			handlerNames = identNames(ci.handleChain)
+		}
+		if handlerNames[name] {
+			continue
+		}
+		if scope != nil {
+			if tc.temps[scope] == nil {
+				tc.temps[scope] = make(map[string]bool)
+			}
+			tc.temps[scope][name] = true
+		}
+		return name
+	}
+}
+
+// inScope reports whether name is declared in scope or a scope enclosing
+// it, by the package or for a check.
+func (tc transformContext) inScope(scope *types.Scope, name string) bool {
+	for s := scope; s != nil; s = s.Parent() {
+		if s.Lookup(name) != nil || tc.temps[s][name] {
+			return true
+		}
+	}
+	return false
+}
+
+// blockScope returns the scope of the block of the check described by ci,
+// or nil if it wasn't type-checked.
+func blockScope(info *types.Info, ci checkInfo) *types.Scope {
+	if s, ok := info.Scopes[ci.block]; ok {
+		return s
+	}
+	// the body of a function shares the scope of its type
+	switch f := ci.fun.(type) {
+	case *ast.FuncDecl:
+		return info.Scopes[f.Type]
+	case *ast.FuncLit:
+		return info.Scopes[f.Type]
+	}
+	return nil
+}
+
+// identNames returns the names of the identifiers in blocks.
+func identNames(blocks []*ast.BlockStmt) map[string]bool {
+	names := make(map[string]bool)
+	for _, b := range blocks {
+		ast.Inspect(b, func(node ast.Node) bool {
+			if id, ok := node.(*ast.Ident); ok {
+				names[id.Name] = true
+			}
+			return true
+		})
+	}
+	return names
 }
 
 func (tc transformContext) deleteExprStmts(gf *go2File) {
@@ -470,9 +685,19 @@ func (tc transformContext) deleteExprStmts(gf *go2File) {
 	}, nil)
 }
 
-func transform(p *go2Package) error {
+func transform(p *go2Package) (err error) {
+	// a directory may only have the orphans left behind by deleted .go2
+	// files, or the generated files of another platform
+	if len(p.files()) == 0 {
+		return nil
+	}
 
 	tc := newTransformContext()
+	defer func() {
+		if r := recover(); r != nil {
+			err = internalError(p.position(*tc.at), r)
+		}
+	}()
 
 	for _, gf := range p.go2Files {
 		ti := buildTreeInfo(gf.f)
@@ -480,35 +705,100 @@ func transform(p *go2Package) error {
 		checks := collectChecksAndHandles(gf, tc.handlerErrNames)
 		tc.buildHandlerChains(gf, ti, lst, checks)
 	}
+	if diags := p.importDiagnostics(); len(diags) > 0 {
+		return diags
+	}
 
-	prevRemaining := len(tc.checks)
-	for {
-		// Print type check errors (which are to be expected, except for on last pass).
-		// Uncomment to debug; add verbose mode?
-		// fmt.Println("------------")
-		// info, err := p.checkTypes(func(err error) { fmt.Println(err) })
-		info, err := p.checkTypes(nil)
+	for _, gf := range p.go2Files {
+		tc.wrapChecks(gf)
+	}
+	// Type check errors are to be expected while arities are wrong,
+	// but those of the last pass are errors of the package, some of
+	// which explain why a check can't be typed.
+	var info *types.Info
+	var typeErrs []error
+	for pass := 0; ; pass++ {
+		decls, err := checkFuncs(p.fset, p.name, tc.maxArity())
 		if err != nil {
 			return err
 		}
-
-		for _, gf := range p.go2Files {
-			tc.consumeTypedChecks(gf, info)
-			tc.deleteExprStmts(gf)
-		}
-
-		if len(tc.checks) == 0 {
-			break
+		typeErrs = nil
+		info, err = p.checkTypes(func(err error) {
+			// errors about the wrappers only follow from other errors,
+			// or from an arity that's fixed by the next pass, and soft
+			// errors, such as unused imports and variables, may only
+			// be errors because the handlers aren't checked
+			if te, ok := err.(types.Error); ok && te.Soft {
+				return
+			}
+			if !strings.Contains(err.Error(), checkFunc) {
+				typeErrs = append(typeErrs, err)
+			}
+		}, decls)
+		if err != nil {
+			return err
 		}
-		if len(tc.checks) == prevRemaining {
-			fmt.Println("ERROR: failed to complete code generation; .go2 code is likely incorrect")
+		// another pass is only needed when an arity was guessed wrong,
+		// and every pass gives at least one more check the arity of its
+		// operand, so this bound only guards against a bug
+		if tc.fixArities(info) == 0 || pass == len(tc.wrappers) {
 			break
 		}
-		prevRemaining = len(tc.checks)
+	}
+
+	var diags diagnostics
+	for _, gf := range p.go2Files {
+		diags = append(diags, tc.consumeTypedChecks(gf, info)...)
+		tc.deleteExprStmts(gf)
+	}
+	if len(tc.checks) > 0 {
+		return append(diags, tc.unresolved(p, typeErrs)...)
+	}
+	for _, err := range typeErrs {
+		diags = append(diags, p.typeDiagnostic(err))
+	}
+	if len(diags) > 0 {
+		sortDiagnostics(diags)
+		return diags
 	}
 	return nil
 }
 
+// unresolved returns a diagnostic for each check that couldn't be typed,
+// followed by the type errors of the last pass that fall within its
+// operand, and then the remaining type errors, one of which must be the
+// cause of the checks that none of them fall within.
+func (tc transformContext) unresolved(p *go2Package, typeErrs []error) diagnostics {
+	var exprs []ast.Expr
+	for expr := range tc.checks {
+		exprs = append(exprs, expr)
+	}
+	sort.Slice(exprs, func(i, j int) bool {
+		return exprs[i].Pos() < exprs[j].Pos()
+	})
+
+	var diags diagnostics
+	listed := make(map[int]bool) // indexes into typeErrs
+	for _, expr := range exprs {
+		msg := fmt.Sprintf("unresolved check: can't determine the type of check %s", types.ExprString(expr))
+		diags = append(diags, newDiagnostic(p.position(expr.Pos()), codeUnresolvedCheck, msg))
+		for i, err := range typeErrs {
+			te, ok := err.(types.Error)
+			if !ok || te.Pos < expr.Pos() || te.Pos >= expr.End() {
+				continue
+			}
+			diags = append(diags, p.typeDiagnostic(err))
+			listed[i] = true
+		}
+	}
+	for i, err := range typeErrs {
+		if !listed[i] {
+			diags = append(diags, p.typeDiagnostic(err))
+		}
+	}
+	return diags
+}
+
 // for debugging
 func nodeString(node ast.Node) string {
 	fset := token.NewFileSet()
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckArity(t *testing.T) {
+	// the arity of the check in the call to first is only known once it's
+	// typed, and the check after it can only be typed after that
+	src := `package a
+
+type T struct{}
+
+func (T) Next() (T, error) { return T{}, nil }
+
+func pair() (T, T, error) { return T{}, T{}, nil }
+
+func first[A any](a, b A) A { return a }
+
+func f() error {
+	t := first(check pair())
+	u := check t.Next()
+	_ = u
+	return nil
+}
+`
+	dir := tempPkg(t, map[string]string{"a.go2": src})
+	defer os.RemoveAll(dir)
+
+	p, err := parsePkg(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transform(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := p.go2Files[0].string()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"_go2T0, _go2T1, _go2error0 := pair()",
+		"t := first(_go2T0, _go2T1)",
+		"_go2T2, _go2error1 := t.Next()",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestCheckTypeNames(t *testing.T) {
+	src := `package a
+
+type G[T any] struct{ v T }
+
+type E struct{}
+
+func (*E) Error() string { return "E" }
+
+func c() (chan int, error)       { return nil, nil }
+func fn() (func(), error)        { return nil, nil }
+func i() (interface{}, error)    { return nil, nil }
+func s() (struct{ X int }, error) { return struct{ X int }{}, nil }
+func g() (G[int], error)         { return G[int]{}, nil }
+func e() (int, *E)               { return 0, nil }
+
+func f() error {
+	_, _, _, _, _ = check c(), check fn(), check i(), check s(), check g()
+	return nil
+}
+
+func a() ([2]int, error) {
+	_ = check e()
+	return [2]int{1}, nil
+}
+`
+	dir := tempPkg(t, map[string]string{"a.go2": src})
+	defer os.RemoveAll(dir)
+
+	p, err := parsePkg(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := transform(p); err != nil {
+		t.Fatal(err)
+	}
+	out, err := p.go2Files[0].string()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"_go2chanInt0", "_go2func0", "_go2iface0", "_go2struct0", "_go2G0", "_go2int0"} {
+		if !strings.Contains(out, want+", _go2error") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	// the error of e is a *E, and a's zero value an array
+	if want := "return [2]int{}, _go2error"; !strings.Contains(out, want) {
+		t.Errorf("missing %q in:\n%s", want, out)
+	}
+}
+
+func TestUnparsable(t *testing.T) {
+	src := "package a\n\nfunc f() (int, error) { return 0, nil }\n\nfunc g() error {\n\tx := check f()\n\t_ = x\n\treturn nil\n}\n"
+	dir := tempPkg(t, map[string]string{"a.go2": src})
+	defer os.RemoveAll(dir)
+
+	p, err := parsePkg(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := transform(p); err != nil {
+		t.Fatal(err)
+	}
+	gf := p.go2Files[0]
+	ast.Inspect(gf.f, func(node ast.Node) bool {
+		if id, ok := node.(*ast.Ident); ok && id.Name == "_go2int0" {
+			id.Name = "_go2chan int0"
+		}
+		return true
+	})
+	_, err = gf.string()
+	diags, ok := err.(diagnostics)
+	if !ok || len(diags) != 1 || diags[0].Line != 6 || diags[0].Code != codeInternal {
+		t.Errorf("got %v, want an internal error on line 6", err)
+	}
+}
+
+// benchPkg returns a package with funcs functions, each made of a chain of
+// depth checks, where the operand of every check is a method call on the
+// value of the previous one. Its type is thus only known once the previous
+// check is typed.
+func benchPkg(b *testing.B, funcs, depth int) string {
+	var sb strings.Builder
+	sb.WriteString("package bench\n\ntype T struct{}\n\nfunc (T) Next() (T, error) { return T{}, nil }\n")
+	for i := 0; i < funcs; i++ {
+		fmt.Fprintf(&sb, "\nfunc f%d(t0 T) (T, error) {\n", i)
+		for j := 1; j <= depth; j++ {
+			fmt.Fprintf(&sb, "\tt%d := check t%d.Next()\n", j, j-1)
+		}
+		fmt.Fprintf(&sb, "\treturn t%d, nil\n}\n", depth)
+	}
+	return tempPkg(b, map[string]string{"bench.go2": sb.String()})
+}
+
+func BenchmarkTransform(b *testing.B) {
+	for _, bb := range []struct{ funcs, depth int }{
+		{2000, 1},
+		{200, 10},
+		{100, 20},
+	} {
+		b.Run(fmt.Sprintf("checks=%d/depth=%d", bb.funcs*bb.depth, bb.depth), func(b *testing.B) {
+			dir := benchPkg(b, bb.funcs, bb.depth)
+			defer os.RemoveAll(dir)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				p, err := parsePkg(dir)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				err = transform(p)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
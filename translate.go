@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// fileRef matches file:line and file:line:col references to .go files,
+// as found in compiler, vet and linter output, test failures and panics.
+var fileRef = regexp.MustCompile(`([^\s:"'()\[\]]+\.go):(\d+)(?::(\d+))?`)
+
+// A translator rewrites references to generated files
+// into references to their .go2 sources.
+type translator struct {
+	maps   map[string]*posMap   // absolute path -> map
+	byBase map[string][]*posMap // base name -> maps
+}
+
+func newTranslator() *translator {
+	return &translator{
+		maps:   make(map[string]*posMap),
+		byBase: make(map[string][]*posMap),
+	}
+}
+
+// add registers the map of a generated file, which may be found at path.
+func (t *translator) add(path string, m *posMap) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	t.maps[abs] = m
+	base := filepath.Base(path)
+	t.byBase[base] = append(t.byBase[base], m)
+	return nil
+}
+
+// addPackages transpiles the packages in dirs and registers their generated
+// files. Packages that fail to transpile are logged and left out.
+func (t *translator) addPackages(dirs []string) error {
+	for _, tp := range transpileAll(dirs) {
+		if tp.err != nil {
+			report(tp.dir, tp.err)
+			continue
+		}
+		for _, f := range tp.files {
+			if f.pos == nil {
+				continue
+			}
+			err := t.add(f.path, f.pos)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// translatePositions copies standard input to standard output, translating
+// references to the files generated for the packages matching patterns.
+func translatePositions(patterns []string) error {
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+	dirs, err := expandPatterns(patterns)
+	if err != nil {
+		return err
+	}
+	t := newTranslator()
+	err = t.addPackages(dirs)
+	if err != nil {
+		return err
+	}
+	return t.copy(os.Stdout, os.Stdin)
+}
+
+func (t *translator) find(path string) *posMap {
+	if filepath.Base(path) == path {
+		// test output only has base names;
+		// those can only be translated if they are unambiguous
+		if ms := t.byBase[path]; len(ms) == 1 {
+			return ms[0]
+		}
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	return t.maps[abs]
+}
+
+// line translates every file reference in s.
+func (t *translator) line(s string) string {
+	return fileRef.ReplaceAllStringFunc(s, func(ref string) string {
+		sub := fileRef.FindStringSubmatch(ref)
+		m := t.find(sub[1])
+		if m == nil {
+			return ref
+		}
+		line, _ := strconv.Atoi(sub[2])
+		col := 0
+		if sub[3] != "" {
+			col, _ = strconv.Atoi(sub[3])
+		}
+		p := m.lookup(line, col)
+
+		name := p.Filename
+		if filepath.Base(sub[1]) == sub[1] {
+			name = filepath.Base(name)
+		} else if filepath.IsAbs(sub[1]) && !filepath.IsAbs(name) {
+			if abs, err := filepath.Abs(name); err == nil {
+				name = abs
+			}
+		}
+		ref = name + ":" + strconv.Itoa(p.Line)
+		if sub[3] != "" {
+			ref += ":" + strconv.Itoa(p.Column)
+		}
+		return ref
+	})
+}
+
+// copy translates r line by line into w.
+func (t *translator) copy(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		s, err := br.ReadString('\n')
+		if len(s) > 0 {
+			_, werr := io.WriteString(w, t.line(s))
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
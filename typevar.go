@@ -1,6 +1,10 @@
 package main
 
-import "strings"
+import (
+	"fmt"
+	"go/token"
+	"strings"
+)
 
 func capitalize(s string) string {
 	if len(s) == 0 {
@@ -9,27 +13,50 @@ func capitalize(s string) string {
 	return strings.ToUpper(s[0:1]) + s[1:]
 }
 
-func typeToVar(t string) string {
+// typeToVar turns t, a type as go/types prints it, into an identifier
+// to name variables of the type after, such as slcPtrFoo for []*pkg.foo.
+func typeToVar(t string) (string, error) {
 	switch {
 	case len(t) > 4 && t[0:4] == "map[":
 		return mapTypeToVar(t)
 	case len(t) > 2 && t[0:2] == "[]":
-		return "slc" + capitalize(typeToVar(t[2:]))
+		return prefixTypeToVar("slc", t[2:])
 	case len(t) > 1 && t[0] == '[':
 		return arrTypeToVar(t)
 	case len(t) > 1 && t[0] == '*':
-		return "ptr" + capitalize(typeToVar(t[1:]))
+		return prefixTypeToVar("ptr", t[1:])
+	case len(t) > 2 && t[0] == '(' && t[len(t)-1] == ')':
+		return typeToVar(t[1 : len(t)-1])
+	case strings.HasPrefix(t, "chan "), strings.HasPrefix(t, "chan<- "), strings.HasPrefix(t, "<-chan "):
+		return prefixTypeToVar("chan", t[strings.Index(t, " ")+1:])
+	case strings.HasPrefix(t, "func("):
+		return "func", nil
+	case strings.HasPrefix(t, "struct{"):
+		return "struct", nil
+	case strings.HasPrefix(t, "interface{"):
+		return "iface", nil
 	default:
-		// leave out package name
-		dot := strings.Index(t, ".")
-		if dot < 0 {
-			return t
+		// leave out type arguments and package path
+		if bracket := strings.Index(t, "["); bracket >= 0 {
+			t = t[:bracket]
 		}
-		return typeToVar(t[dot+1:])
+		t = t[strings.LastIndex(t, ".")+1:]
+		if !token.IsIdentifier(t) {
+			return "", fmt.Errorf("invalid type: %s", t)
+		}
+		return t, nil
+	}
+}
+
+func prefixTypeToVar(prefix, t string) (string, error) {
+	v, err := typeToVar(t)
+	if err != nil {
+		return "", err
 	}
+	return prefix + capitalize(v), nil
 }
 
-func mapTypeToVar(t string) string {
+func mapTypeToVar(t string) (string, error) {
 	t = t[4:]
 	bracks := 0
 	for i, c := range t {
@@ -38,21 +65,27 @@ func mapTypeToVar(t string) string {
 			bracks++
 		case ']':
 			if bracks == 0 {
-				key := capitalize(typeToVar(t[:i]))
-				val := capitalize(typeToVar(t[i+1:]))
-				return "mapOf" + key + "To" + val
+				key, err := typeToVar(t[:i])
+				if err != nil {
+					return "", err
+				}
+				val, err := typeToVar(t[i+1:])
+				if err != nil {
+					return "", err
+				}
+				return "mapOf" + capitalize(key) + "To" + capitalize(val), nil
 			}
 			bracks--
 		}
 	}
-	panic("invalid map type: " + t)
+	return "", fmt.Errorf("invalid map type: map[%s", t)
 }
 
-func arrTypeToVar(t string) string {
+func arrTypeToVar(t string) (string, error) {
 	for i, c := range t {
 		if c == ']' {
-			return "arr" + capitalize(typeToVar(t[i+1:]))
+			return prefixTypeToVar("arr", t[i+1:])
 		}
 	}
-	panic("invalid arr type: " + t)
+	return "", fmt.Errorf("invalid array type: %s", t)
 }
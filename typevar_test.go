@@ -17,4 +17,25 @@ func TestTypeToVar(t *testing.T) {
 	f.In("[][][123]**foo").Out("slcSlcArrPtrPtrFoo")
 	f.In("map[int]bool").Out("mapOfIntToBool")
 	f.In("map[map[int]bool][123]*foo").Out("mapOfMapOfIntToBoolToArrPtrFoo")
+	f.In("example.com/m/pkg.foo").Out("foo")
+	f.In("chan int").Out("chanInt")
+	f.In("<-chan []int").Out("chanSlcInt")
+	f.In("chan<- *foo").Out("chanPtrFoo")
+	f.In("chan (<-chan int)").Out("chanChanInt")
+	f.In("func()").Out("func")
+	f.In("[]func(int) (string, error)").Out("slcFunc")
+	f.In("map[string]func([]int)").Out("mapOfStringToFunc")
+	f.In("interface{}").Out("iface")
+	f.In("interface{M() int}").Out("iface")
+	f.In("struct{X int}").Out("struct")
+	f.In("pkg.G[int]").Out("G")
+	f.In("example.com/m/pkg.G[example.com/m/pkg.foo, map[int]bool]").Out("G")
+}
+
+func TestTypeToVarInvalid(t *testing.T) {
+	f := fun.Test(t, typeToVar)
+	f.In("map[int").Err()
+	f.In("[123").Err()
+	f.In("[]map[int").Err()
+	f.In("invalid type").Err()
 }
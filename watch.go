@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	pollInterval = 250 * time.Millisecond
+
+	// changes are only acted on once a package has been quiet this long,
+	// so that a burst of saves results in a single regeneration
+	debounce = 300 * time.Millisecond
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// snapshot records the state of the source files of a package.
+type snapshot map[string]fileStamp
+
+func (s snapshot) equal(other snapshot) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for name, stamp := range s {
+		o, ok := other[name]
+		if !ok || !o.modTime.Equal(stamp.modTime) || o.size != stamp.size {
+			return false
+		}
+	}
+	return true
+}
+
+// takeSnapshot records the .go2 and .go files in dir. The type-checking
+// done by transform depends on every .go file of the package, so those are
+// included as well, except for the ones go2gen generated itself, which
+// parsePkg skips.
+func takeSnapshot(dir string) (snapshot, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := d.Readdir(0)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	s := make(snapshot)
+	for _, info := range infos {
+		name := info.Name()
+		ext := filepath.Ext(name)
+		if info.IsDir() || (ext != ".go" && ext != extension) {
+			continue
+		}
+		if ext == ".go" {
+			generated, err := hasGeneratedHeader(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			if generated {
+				continue
+			}
+		}
+		s[name] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return s, nil
+}
+
+// watch transpiles the packages matching patterns, and then keeps polling
+// them, regenerating the packages whenever the source files of one change.
+// The packages importing the changed ones are regenerated along with them,
+// since they may change too, but only the changed ones and failures are
+// logged. It only returns if the patterns can't be expanded.
+func watch(patterns []string) error {
+	wlog := log.New(os.Stderr, "", log.Ltime)
+
+	last := make(map[string]transpiled) // dir -> last outcome
+	regenerate := func(dirs []string, changed map[string]bool) {
+		start := time.Now()
+		selected, affected := affectedDirs(dirs, changed, last)
+		for _, t := range transpileAll(selected) {
+			last[t.dir] = transpiled{dir: t.dir, path: t.path, imports: t.imports}
+			if !affected[t.dir] {
+				continue
+			}
+			if changed[t.dir] && len(t.warnings) > 0 {
+				report(t.dir, t.warnings)
+			}
+			err := t.err
+			if err == nil {
+				err = writeFiles(t.files)
+			}
+			if err != nil {
+				wlog.Printf("%s: failed", t.dir)
+				report(t.dir, err)
+				continue
+			}
+			if changed[t.dir] {
+				wlog.Printf("%s: ok (%v)", t.dir, time.Since(start).Round(time.Millisecond))
+			}
+		}
+	}
+
+	snapshots := make(map[string]snapshot)
+	pending := make(map[string]time.Time) // dir -> time of last change
+
+	for {
+		dirs, err := expandPatterns(patterns)
+		if err != nil {
+			return err
+		}
+
+		seen := make(map[string]bool)
+		changed := make(map[string]bool)
+		var watched []string
+		for _, dir := range dirs {
+			seen[dir] = true
+			s, err := takeSnapshot(dir)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				wlog.Printf("%s: %v", dir, err)
+				continue
+			}
+			watched = append(watched, dir)
+			prev, ok := snapshots[dir]
+			snapshots[dir] = s
+			if !ok {
+				// a new package; transpile it right away
+				changed[dir] = true
+				continue
+			}
+			if !s.equal(prev) {
+				pending[dir] = time.Now()
+			}
+		}
+		for dir := range snapshots {
+			if !seen[dir] {
+				delete(snapshots, dir)
+				delete(pending, dir)
+				delete(last, dir)
+			}
+		}
+
+		settled(dirs, pending, time.Now(), changed)
+		if len(changed) > 0 {
+			regenerate(watched, changed)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// settled moves the packages among dirs whose last change, as recorded in
+// pending, is at least debounce old at now from pending to changed.
+func settled(dirs []string, pending map[string]time.Time, now time.Time, changed map[string]bool) {
+	for _, dir := range dirs {
+		changedAt, ok := pending[dir]
+		if !ok || now.Sub(changedAt) < debounce {
+			continue
+		}
+		delete(pending, dir)
+		changed[dir] = true
+	}
+}
+
+// affectedDirs returns the packages among dirs that are affected by the
+// changes to those in changed, given the last outcomes of the packages:
+// the changed ones and those importing them, directly or not. It also
+// returns the packages to transpile for them, in the order of dirs, which
+// include the packages they import, as they are type-checked against them.
+func affectedDirs(dirs []string, changed map[string]bool, last map[string]transpiled) ([]string, map[string]bool) {
+	byPath := make(map[string]string)
+	for _, dir := range dirs {
+		path := last[dir].path
+		if path == "" {
+			// the package failed to parse, but may still be imported
+			path, _ = importPath(dir)
+		}
+		if path != "" {
+			byPath[path] = dir
+		}
+	}
+	importers := make(map[string][]string)
+	for _, dir := range dirs {
+		for _, path := range last[dir].imports {
+			if imported, ok := byPath[path]; ok {
+				importers[imported] = append(importers[imported], dir)
+			}
+		}
+	}
+
+	affected := make(map[string]bool)
+	var visit func(dir string)
+	visit = func(dir string) {
+		if affected[dir] {
+			return
+		}
+		affected[dir] = true
+		for _, importer := range importers[dir] {
+			visit(importer)
+		}
+	}
+	for dir := range changed {
+		visit(dir)
+	}
+
+	needed := make(map[string]bool)
+	var need func(dir string)
+	need = func(dir string) {
+		if needed[dir] {
+			return
+		}
+		needed[dir] = true
+		for _, path := range last[dir].imports {
+			if imported, ok := byPath[path]; ok {
+				need(imported)
+			}
+		}
+	}
+	for dir := range affected {
+		need(dir)
+	}
+
+	var selected []string
+	for _, dir := range dirs {
+		if needed[dir] {
+			selected = append(selected, dir)
+		}
+	}
+	return selected, affected
+}
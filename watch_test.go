@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := tempPkg(t, map[string]string{
+		"a.go2":     "package a\n",
+		"b.go":      "package a\n",
+		"a.go":      generatedComment + "\n\npackage a\n",
+		"x.txt":     "notes\n",
+		"sub/c.go2": "package c\n",
+	})
+	defer os.RemoveAll(dir)
+
+	s, err := takeSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// generated files, other files and subdirectories are left out
+	if len(s) != 2 || s["a.go2"] == (fileStamp{}) || s["b.go"] == (fileStamp{}) {
+		t.Fatalf("got snapshot %v, want a.go2 and b.go", s)
+	}
+
+	// regenerating a.go isn't a change
+	err = ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte(generatedComment+"\n\npackage a\n\nvar A int\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2, err := takeSnapshot(dir); err != nil || !s2.equal(s) {
+		t.Errorf("got %v, %v after regenerating a.go, want %v", s2, err, s)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "b.go"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if s2, err := takeSnapshot(dir); err != nil || s2.equal(s) {
+		t.Errorf("got %v, %v after touching b.go, want a change", s2, err)
+	}
+}
+
+func TestSettled(t *testing.T) {
+	now := time.Now()
+	pending := map[string]time.Time{
+		"a": now.Add(-debounce),
+		"b": now.Add(-debounce / 2),
+		"c": now.Add(-time.Hour),
+	}
+	changed := map[string]bool{"d": true}
+	// c is no longer watched
+	settled([]string{"a", "b", "d"}, pending, now, changed)
+	if want := map[string]bool{"a": true, "d": true}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("got changed %v, want %v", changed, want)
+	}
+	if _, ok := pending["a"]; ok || len(pending) != 2 {
+		t.Errorf("got pending %v, want b and c", pending)
+	}
+}
+
+func TestAffectedDirs(t *testing.T) {
+	// a imports b, which imports c; d imports c, and e is on its own
+	dirs := []string{"a", "b", "c", "d", "e"}
+	last := map[string]transpiled{
+		"a": {path: "m/a", imports: []string{"fmt", "m/b"}},
+		"b": {path: "m/b", imports: []string{"m/c"}},
+		"c": {path: "m/c"},
+		"d": {path: "m/d", imports: []string{"m/c"}},
+		"e": {path: "m/e"},
+	}
+	tests := []struct {
+		changed            []string
+		selected, affected []string
+	}{
+		{[]string{"a"}, []string{"a", "b", "c"}, []string{"a"}},
+		{[]string{"b"}, []string{"a", "b", "c"}, []string{"a", "b"}},
+		{[]string{"c"}, []string{"a", "b", "c", "d"}, []string{"a", "b", "c", "d"}},
+		{[]string{"e"}, []string{"e"}, []string{"e"}},
+		{[]string{"d", "e"}, []string{"c", "d", "e"}, []string{"d", "e"}},
+	}
+	for _, tt := range tests {
+		changed := make(map[string]bool)
+		for _, dir := range tt.changed {
+			changed[dir] = true
+		}
+		selected, affected := affectedDirs(dirs, changed, last)
+		var affectedDirs []string
+		for _, dir := range dirs {
+			if affected[dir] {
+				affectedDirs = append(affectedDirs, dir)
+			}
+		}
+		if !reflect.DeepEqual(selected, tt.selected) || !reflect.DeepEqual(affectedDirs, tt.affected) {
+			t.Errorf("changed %v: got %v and affected %v, want %v and affected %v",
+				tt.changed, selected, affectedDirs, tt.selected, tt.affected)
+		}
+	}
+}
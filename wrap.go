@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// A checkWrapper is a call standing in for a check while the package is
+// type-checked. The operand is passed to a generic function returning its
+// values but the error, as the transformed check does, so the code using
+// the values of a check is typed along with it, and a chain of checks,
+// each using the value of the previous one, is typed in a single pass.
+//
+// The number of values returned, the arity, is taken from the context of
+// the check. Where that's ambiguous, as for the only argument of a call,
+// a single value is assumed, and if the operand turns out to have another
+// number of values, the package is type-checked again with the right one.
+// A wrong guess can leave other checks untyped, such as one whose operand
+// is inferred from the values of the first, so the number of passes is
+// bounded by how deeply such checks are nested, not by a constant.
+type checkWrapper struct {
+	call  *ast.CallExpr
+	arity int // -1 if the values are discarded
+}
+
+func (w *checkWrapper) setArity(n int) {
+	w.arity = n
+	name := checkFunc
+	if n >= 0 {
+		name += strconv.Itoa(n)
+	}
+	w.call.Fun.(*ast.Ident).Name = name
+}
+
+// wrapChecks replaces the checks of gf with wrappers.
+func (tc transformContext) wrapChecks(gf *go2File) {
+	astutil.Apply(gf.f, nil, func(c *astutil.Cursor) bool {
+		expr, ok := c.Node().(ast.Expr)
+		if !ok {
+			return true
+		}
+		info, ok := tc.checks[expr]
+		if !ok {
+			return true
+		}
+		w := &checkWrapper{call: &ast.CallExpr{
+			Fun:    &ast.Ident{NamePos: expr.Pos()},
+			Lparen: expr.Pos(),
+			Args:   []ast.Expr{expr},
+			Rparen: expr.End() - 1,
+		}}
+		w.setArity(contextArity(c.Parent(), info.fun))
+		tc.wrappers[expr] = w
+		c.Replace(w.call)
+		return true
+	})
+}
+
+// unwrap puts the check of the wrapper at c back in its place, and
+// returns it. It returns nil if there is no wrapper at c.
+func (tc transformContext) unwrap(c *astutil.Cursor) ast.Expr {
+	call, ok := c.Node().(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return nil
+	}
+	expr := call.Args[0]
+	if w, ok := tc.wrappers[expr]; !ok || w.call != call {
+		return nil
+	}
+	c.Replace(expr)
+	return expr
+}
+
+// fixArities gives the wrappers of the checks typed by info the arity of
+// their operands, and returns how many of them changed. Wrappers whose
+// values are discarded, and checks that are invalid, are left alone.
+func (tc transformContext) fixArities(info *types.Info) int {
+	changed := 0
+	for expr, w := range tc.wrappers {
+		n, ok := checkArity(info.TypeOf(expr))
+		if !ok || w.arity < 0 || n == 0 || n == w.arity {
+			continue
+		}
+		w.setArity(n)
+		changed++
+	}
+	return changed
+}
+
+func (tc transformContext) maxArity() int {
+	max := 1
+	for _, w := range tc.wrappers {
+		if w.arity > max {
+			max = w.arity
+		}
+	}
+	return max
+}
+
+// contextArity returns the number of values that parent expects of a
+// check, which is in function fun, or -1 if they are discarded.
+func contextArity(parent ast.Node, fun ast.Node) int {
+	switch v := parent.(type) {
+	case *ast.ExprStmt:
+		return -1
+	case *ast.AssignStmt:
+		if len(v.Rhs) == 1 {
+			return len(v.Lhs)
+		}
+	case *ast.ReturnStmt:
+		if len(v.Results) == 1 {
+			return resultCount(fun)
+		}
+	}
+	return 1
+}
+
+// resultCount returns the number of results of fun, or 1 if it has none.
+func resultCount(fun ast.Node) int {
+	var ft *ast.FuncType
+	switch v := fun.(type) {
+	case *ast.FuncDecl:
+		ft = v.Type
+	case *ast.FuncLit:
+		ft = v.Type
+	}
+	if ft == nil || ft.Results == nil {
+		return 1
+	}
+	n := 0
+	for _, field := range ft.Results.List {
+		if len(field.Names) == 0 {
+			n++
+		} else {
+			n += len(field.Names)
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+// checkArity returns the number of values other than the error of a check
+// whose operand has type t, and whether t is known and ends in an error.
+func checkArity(t types.Type) (int, bool) {
+	if !isDefined(t) {
+		return 0, false
+	}
+	if v, ok := t.(*types.Tuple); ok {
+		if v.Len() == 0 || !isError(v.At(v.Len()-1).Type()) {
+			return 0, false
+		}
+		return v.Len() - 1, true
+	}
+	return 0, isError(t)
+}
+
+var errorInterface = types.Universe.Lookup("error").Type().Underlying().(*types.Interface)
+
+// isError reports whether the values of type t are errors, which includes
+// the types implementing error, such as *os.PathError.
+func isError(t types.Type) bool {
+	return types.Implements(t, errorInterface)
+}
+
+// checkFuncs returns a file of package pkg declaring the functions called
+// by wrappers, for up to max values.
+func checkFuncs(fset *token.FileSet, pkg string, max int) (*ast.File, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "package %s\n\nfunc %s(...interface{}) {}\n", pkg, checkFunc)
+	for n := 1; n <= max; n++ {
+		params := make([]string, n)
+		for i := range params {
+			params[i] = "T" + strconv.Itoa(i)
+		}
+		ts := strings.Join(params, ", ")
+		fmt.Fprintf(&sb, "\nfunc %s%d[%s any](%s, error) (%s) { panic(0) }\n", checkFunc, n, ts, ts, ts)
+	}
+	return parser.ParseFile(fset, "", sb.String(), 0)
+}